@@ -1,12 +1,17 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"log/slog"
 	"os"
+	"path/filepath"
 
 	"github.com/spf13/viper"
 
+	"github.com/vhakulinen/dino/db/migrations"
 	"github.com/vhakulinen/dino/db/utils"
 )
 
@@ -42,3 +47,145 @@ func (c *Config) ConnParams() *utils.ConnectionParams {
 func (c *Config) MigrationsDir() string {
 	return c.GetString("dino.migrations.dir")
 }
+
+// Returns the source of the migrations. Unless set with OptionMigrationsFS,
+// the migrations directory is used.
+func (c *Config) MigrationsFS() fs.FS {
+	if c.opts.migrationsFS != nil {
+		return c.opts.migrationsFS
+	}
+
+	return os.DirFS(c.MigrationsDir())
+}
+
+// Reports whether new migrations can be created in the migrations source.
+func (c *Config) MigrationsWritable() bool {
+	return c.opts.migrationsFS == nil
+}
+
+// Loads the migration sets from the migrations source, in the configured
+// order. The registered Go migrations are merged into the default set.
+func (c *Config) MigrationSets() (migrations.MigrationSets, error) {
+	sets, err := migrations.MigrationSetsFromFS(c.MigrationsFS())
+	if err != nil {
+		return nil, err
+	}
+
+	if def := sets.Find(""); def != nil {
+		def.Migrations = def.Migrations.Merge(migrations.Registered())
+	}
+
+	return sets.Ordered(c.GetStringSlice("dino.migrations.sets.order"))
+}
+
+// Loads the migrations of the given migration set. See MigrationSets.
+func (c *Config) Migrations(set string) (migrations.MigrationSlice, error) {
+	sets, err := c.MigrationSets()
+	if err != nil {
+		return nil, err
+	}
+
+	s := sets.Find(set)
+	if s == nil {
+		return nil, fmt.Errorf("Unknown migration set: %q", set)
+	}
+
+	return s.Migrations, nil
+}
+
+// Checks the migrations source for problems, taking the registered Go
+// migrations into account. Warnings are returned separately from the error.
+func (c *Config) LintMigrations() ([]migrations.Problem, error) {
+	err := migrations.LintFS(c.MigrationsFS(), migrations.Registered()...)
+
+	var verr *migrations.ValidationError
+	if !errors.As(err, &verr) {
+		return nil, err
+	}
+
+	return verr.SplitWarnings()
+}
+
+// Returns the template for new migrations. Templates are read from up.sql
+// and down.sql in the templates directory if one is configured, or from the
+// dino.migrations.templates.up and .down settings otherwise. Returns nil if no
+// templates are configured.
+func (c *Config) MigrationsTemplate() (*migrations.Template, error) {
+	if dir := c.GetString("dino.migrations.templates.dir"); dir != "" {
+		var t migrations.Template
+		for fname, dst := range map[string]*string{"up.sql": &t.Up, "down.sql": &t.Down} {
+			contents, err := os.ReadFile(filepath.Join(dir, fname))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+
+			*dst = string(contents)
+		}
+
+		return &t, nil
+	}
+
+	up := c.GetString("dino.migrations.templates.up")
+	down := c.GetString("dino.migrations.templates.down")
+	if up == "" && down == "" {
+		return nil, nil
+	}
+
+	return &migrations.Template{Up: up, Down: down}, nil
+}
+
+// Options for running the migrations.
+func (c *Config) MigrationsOptions() []migrations.Option {
+	return append(c.scratchMigrationsOptions(), migrations.OptionHooks(c.opts.hooks...))
+}
+
+// Options for running the migrations in scratch databases, i.e. without the
+// hooks.
+func (c *Config) scratchMigrationsOptions() []migrations.Option {
+	return []migrations.Option{
+		migrations.OptionLogger(c.opts.logger),
+		migrations.OptionLockKey(c.GetInt64("dino.migrations.lock.key")),
+		migrations.OptionLockTimeout(c.GetDuration("dino.migrations.lock.timeout")),
+		migrations.OptionStatementTimeout(c.GetDuration("dino.migrations.statement.timeout")),
+		migrations.OptionAllowOutOfOrder(c.GetBool("dino.migrations.allow.out.of.order")),
+		migrations.OptionEvents(c.opts.events),
+	}
+}
+
+// Switches the logger and the migration events to JSON lines written to w if
+// dino.log.format is json. The text format uses the logger set with
+// OptionMigrationsLogger.
+func (c *Config) setupLogging(w io.Writer) error {
+	switch format := c.GetString("dino.log.format"); format {
+	case "text":
+		return nil
+	case "json":
+		logger := slog.New(slog.NewJSONHandler(w, nil))
+		c.opts.logger = slogLogger{logger}
+		c.opts.events = migrations.SlogEvents(logger)
+		return nil
+	default:
+		return fmt.Errorf("Unknown log format: %q", format)
+	}
+}
+
+// Adapts slog.Logger to migrations.Logger.
+type slogLogger struct {
+	*slog.Logger
+}
+
+func (l slogLogger) Printf(template string, args ...interface{}) {
+	l.Info(fmt.Sprintf(template, args...))
+}
+
+// MigrationsVersioning returns how new migrations are numbered.
+func (c *Config) MigrationsVersioning() (migrations.Versioning, error) {
+	switch v := c.GetString("dino.migrations.versioning"); v {
+	case "sequential":
+		return migrations.VersioningSequential, nil
+	case "timestamp":
+		return migrations.VersioningTimestamp, nil
+	default:
+		return 0, fmt.Errorf("Unknown migrations versioning: %q", v)
+	}
+}
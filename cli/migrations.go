@@ -1,27 +1,81 @@
 package cli
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/spf13/cobra"
 
+	"github.com/vhakulinen/dino/db/catalog"
+	"github.com/vhakulinen/dino/db/fixtures"
 	"github.com/vhakulinen/dino/db/migrations"
+	"github.com/vhakulinen/dino/db/utils"
 )
 
 func migrationsCommand(config *Config) *cobra.Command {
+	var set string
+
+	var newSingleFile bool
+	var newAuthor, newTicket string
 	cmdNew := &cobra.Command{
 		Use:   "new [migration name]",
 		Short: "Create new migration",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			migrations, err := migrations.MigrationsFromFS(os.DirFS(config.MigrationsDir()))
+			if !config.MigrationsWritable() {
+				return errors.New("Migrations source is read-only (e.g. embedded in the binary), create new migrations in the source tree instead")
+			}
+
+			sets, err := config.MigrationSets()
 			if err != nil {
 				return err
 			}
 
-			m, err := migrations.CreateNext(config.MigrationsDir(), strings.Join(args, "_"))
+			// New sets are created on demand.
+			var migs migrations.MigrationSlice
+			if s := sets.Find(set); s != nil {
+				migs = s.Migrations
+			}
+
+			dir := filepath.Join(config.MigrationsDir(), filepath.FromSlash(set))
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+
+			tmpl, err := config.MigrationsTemplate()
+			if err != nil {
+				return err
+			}
+
+			versioning, err := config.MigrationsVersioning()
+			if err != nil {
+				return err
+			}
+
+			create := migs.CreateNext
+			if newSingleFile {
+				create = migs.CreateNextFile
+			}
+
+			m, err := create(
+				dir,
+				strings.Join(args, "_"),
+				migrations.OptionTemplate(tmpl),
+				migrations.OptionTemplateInfo(newAuthor, newTicket),
+				migrations.OptionVersioning(versioning),
+			)
 			if err != nil {
 				return err
 			}
@@ -32,11 +86,17 @@ func migrationsCommand(config *Config) *cobra.Command {
 		},
 	}
 
+	cmdNew.Flags().BoolVar(&newSingleFile, "single-file", false, "Create a single file migration with -- +up and -- +down sections")
+	cmdNew.Flags().StringVar(&newAuthor, "author", os.Getenv("USER"), "Author made available to the migration template")
+	cmdNew.Flags().StringVar(&newTicket, "ticket", "", "Ticket made available to the migration template")
+
+	var revertSteps int
+	var revertAll, revertDryRun bool
 	cmdRevert := &cobra.Command{
 		Use:   "revert",
 		Short: "Revert the latest migration",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			migs, err := migrations.MigrationsFromFS(os.DirFS(config.MigrationsDir()))
+			migs, err := config.Migrations(set)
 			if err != nil {
 				return err
 			}
@@ -46,17 +106,390 @@ func migrationsCommand(config *Config) *cobra.Command {
 				return err
 			}
 
+			if revertSteps < 1 {
+				return fmt.Errorf("Invalid number of steps: %d", revertSteps)
+			}
+
+			steps := revertSteps
+			if revertAll {
+				steps = -1
+			}
+
 			return pgx.BeginFunc(cmd.Context(), db, func(tx pgx.Tx) error {
-				return migs.RevertCurrent(cmd.Context(), tx)
+				if !revertDryRun {
+					if err := migrations.Lock(cmd.Context(), tx, config.MigrationsOptions()...); err != nil {
+						return err
+					}
+				}
+
+				plan, err := migs.RevertPlan(cmd.Context(), tx, steps)
+				if err != nil {
+					return err
+				}
+
+				if revertDryRun {
+					return plan.WriteDownSQL(cmd.OutOrStdout())
+				}
+
+				if len(plan) == 0 {
+					config.opts.logger.Printf("Nothing to revert")
+					return nil
+				}
+
+				return migs.RevertSteps(cmd.Context(), tx, steps, config.MigrationsOptions()...)
 			})
 		},
 	}
+	cmdRevert.Flags().IntVarP(&revertSteps, "steps", "n", 1, "Number of migrations to revert")
+	cmdRevert.Flags().BoolVar(&revertAll, "all", false, "Revert all applied migrations")
+	cmdRevert.Flags().BoolVar(&revertDryRun, "dry-run", false, "Print the SQL that would be run without running it")
+	cmdRevert.MarkFlagsMutuallyExclusive("steps", "all")
 
+	var applyDryRun bool
+	var applyPlanFile, applyTransactionMode string
 	cmdApply := &cobra.Command{
 		Use:   "apply",
-		Short: "Apply all migrations",
+		Short: "Apply all migrations of all migration sets",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			warnings, err := config.LintMigrations()
+			if err != nil {
+				return err
+			}
+
+			for _, w := range warnings {
+				config.opts.logger.Printf("%s", w)
+			}
+
+			sets, err := config.MigrationSets()
+			if err != nil {
+				return err
+			}
+
+			// Apply only the selected set, if any.
+			if cmd.Flags().Changed("set") {
+				s := sets.Find(set)
+				if s == nil {
+					return fmt.Errorf("Unknown migration set: %q", set)
+				}
+
+				sets = migrations.MigrationSets{*s}
+			}
+
+			db, err := pgx.Connect(cmd.Context(), config.ConnParams().ConnString())
+			if err != nil {
+				return err
+			}
+
+			if applyDryRun || applyPlanFile != "" {
+				return writeApplyPlan(cmd, db, sets, applyPlanFile, config.MigrationsOptions()...)
+			}
+
+			mode, err := parseTransactionMode(applyTransactionMode)
+			if err != nil {
+				return err
+			}
+
+			opts := append(config.MigrationsOptions(), mode)
+			return sets.ApplyAll(cmd.Context(), db, config.opts.logger, opts...)
+		},
+	}
+	cmdApply.Flags().BoolVar(&applyDryRun, "dry-run", false, "Print the SQL that would be run without running it")
+	cmdApply.Flags().StringVar(&applyPlanFile, "plan-file", "", "Write the SQL that would be run to a file without running it")
+	cmdApply.Flags().StringVar(&applyTransactionMode, "transaction-mode", "single", "Run all migrations in a single transaction (single) or commit each on its own (per-migration)")
+
+	cmdLint := &cobra.Command{
+		Use:   "lint",
+		Short: "Check the migrations directory for problems",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			warnings, err := config.LintMigrations()
+			if err != nil {
+				return err
+			}
+
+			for _, w := range warnings {
+				config.opts.logger.Printf("%s", w)
+			}
+
+			if len(warnings) > 0 {
+				config.opts.logger.Printf("%d warning(s) found", len(warnings))
+			} else {
+				config.opts.logger.Printf("No problems found")
+			}
+
+			return nil
+		},
+	}
+
+	cmdVerify := &cobra.Command{
+		Use:   "verify",
+		Short: "Verify that applied migrations have not been modified",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			migs, err := config.Migrations(set)
+			if err != nil {
+				return err
+			}
+
+			db, err := pgx.Connect(cmd.Context(), config.ConnParams().ConnString())
+			if err != nil {
+				return err
+			}
+
+			err = pgx.BeginFunc(cmd.Context(), db, func(tx pgx.Tx) error {
+				if err := migrations.CheckSchema(cmd.Context(), tx); err != nil {
+					return err
+				}
+
+				return migs.Verify(cmd.Context(), tx)
+			})
+			if err != nil {
+				return err
+			}
+
+			config.opts.logger.Printf("Applied migrations match the migrations directory")
+
+			return nil
+		},
+	}
+
+	cmdGoto := &cobra.Command{
+		Use:   "goto [migration number]",
+		Short: "Apply or revert migrations until the given migration",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			target, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("Invalid migration number: %v", err)
+			}
+
+			migs, err := config.Migrations(set)
+			if err != nil {
+				return err
+			}
+
+			db, err := pgx.Connect(cmd.Context(), config.ConnParams().ConnString())
+			if err != nil {
+				return err
+			}
+
+			return migs.MigrateTo(cmd.Context(), db, target, config.opts.logger, config.MigrationsOptions()...)
+		},
+	}
+
+	var renumberDryRun bool
+	cmdRenumber := &cobra.Command{
+		Use:   "renumber",
+		Short: "Renumber migrations one after the other, e.g. after merging branches that added the same number",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !config.MigrationsWritable() {
+				return errors.New("Migrations source is read-only (e.g. embedded in the binary), renumber the migrations in the source tree instead")
+			}
+
+			migs, err := config.Migrations(set)
+			if err != nil {
+				return err
+			}
+
+			db, err := pgx.Connect(cmd.Context(), config.ConnParams().ConnString())
+			if err != nil {
+				return err
+			}
+
+			var renames []migrations.Rename
+			err = pgx.BeginFunc(cmd.Context(), db, func(tx pgx.Tx) error {
+				if err := migrations.CheckSchema(cmd.Context(), tx); err != nil {
+					return err
+				}
+
+				renames, err = migs.RenumberPlan(cmd.Context(), tx)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			if len(renames) == 0 {
+				config.opts.logger.Printf("Nothing to renumber")
+				return nil
+			}
+
+			for _, r := range renames {
+				if renumberDryRun {
+					fmt.Fprintf(cmd.OutOrStdout(), "%s -> %s\n", r.From, r.To)
+				} else {
+					config.opts.logger.Printf("Renaming '%s' to '%s'", r.From, r.To)
+				}
+			}
+
+			if renumberDryRun {
+				return nil
+			}
+
+			dir := filepath.Join(config.MigrationsDir(), filepath.FromSlash(set))
+			return migrations.RenameMigrations(dir, renames)
+		},
+	}
+	cmdRenumber.Flags().BoolVar(&renumberDryRun, "dry-run", false, "Print the renames without renaming anything")
+
+	var squashUpTo int
+	cmdSquash := &cobra.Command{
+		Use:   "squash",
+		Short: "Replace the migrations up to --up-to with a baseline holding the schema they create",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !config.MigrationsWritable() {
+				return errors.New("Migrations source is read-only (e.g. embedded in the binary), squash the migrations in the source tree instead")
+			}
+
+			migs, err := config.Migrations(set)
+			if err != nil {
+				return err
+			}
+
+			if migs.Find(squashUpTo) == nil {
+				return fmt.Errorf("Migration %d not found", squashUpTo)
+			}
+
+			var schema []byte
+			err = withScratchDB(cmd.Context(), config, func(params *utils.ConnectionParams) error {
+				db, err := pgx.Connect(cmd.Context(), params.ConnString())
+				if err != nil {
+					return err
+				}
+				defer db.Close(context.Background())
+
+				config.opts.logger.Printf("Migrating a scratch database to %d...", squashUpTo)
+				if err := migs.MigrateTo(cmd.Context(), db, squashUpTo, config.opts.logger, config.scratchMigrationsOptions()...); err != nil {
+					return err
+				}
+
+				schema, err = fixtures.DumpSchema(params)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			dir := filepath.Join(config.MigrationsDir(), filepath.FromSlash(set))
+			m, err := migs.Squash(dir, squashUpTo, string(schema))
+			if err != nil {
+				return err
+			}
+
+			config.opts.logger.Printf("Squashed the migrations up to %d into '%s'", squashUpTo, m.Name)
+
+			return nil
+		},
+	}
+	cmdSquash.Flags().IntVar(&squashUpTo, "up-to", 0, "Number of the last migration to squash")
+	cmdSquash.MarkFlagRequired("up-to")
+
+	var diffOutput string
+	cmdDiff := &cobra.Command{
+		Use:   "diff",
+		Short: "Compare the database schema with the schema the migrations create",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sets, err := config.MigrationSets()
+			if err != nil {
+				return err
+			}
+
+			var expected *catalog.Schema
+			err = withScratchDB(cmd.Context(), config, func(params *utils.ConnectionParams) error {
+				db, err := pgx.Connect(cmd.Context(), params.ConnString())
+				if err != nil {
+					return err
+				}
+				defer db.Close(context.Background())
+
+				config.opts.logger.Printf("Migrating a scratch database...")
+				if err := sets.ApplyAll(cmd.Context(), db, config.opts.logger, config.scratchMigrationsOptions()...); err != nil {
+					return err
+				}
+
+				expected, err = catalog.Snapshot(cmd.Context(), db)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			db, err := pgx.Connect(cmd.Context(), config.ConnParams().ConnString())
+			if err != nil {
+				return err
+			}
+
+			actual, err := catalog.Snapshot(cmd.Context(), db)
+			if err != nil {
+				return err
+			}
+
+			diffs := catalog.Diff(expected, actual)
+
+			switch diffOutput {
+			case "text":
+				if len(diffs) == 0 {
+					config.opts.logger.Printf("Database matches the migrations")
+				}
+
+				for _, d := range diffs {
+					fmt.Fprintln(cmd.OutOrStdout(), d)
+				}
+			case "json":
+				if diffs == nil {
+					diffs = []catalog.Difference{}
+				}
+
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(diffs); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("Unknown output format: %q", diffOutput)
+			}
+
+			if len(diffs) > 0 {
+				return fmt.Errorf("Database differs from the migrations in %d place(s)", len(diffs))
+			}
+
+			return nil
+		},
+	}
+	cmdDiff.Flags().StringVarP(&diffOutput, "output", "o", "text", "Output format (text or json)")
+
+	cmdRoundTrip := &cobra.Command{
+		Use:   "test-roundtrip",
+		Short: "Check that each migration can be reverted and applied again, using a scratch database",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			migs, err := config.Migrations(set)
+			if err != nil {
+				return err
+			}
+
+			err = withScratchDB(cmd.Context(), config, func(params *utils.ConnectionParams) error {
+				db, err := pgx.Connect(cmd.Context(), params.ConnString())
+				if err != nil {
+					return err
+				}
+				defer db.Close(context.Background())
+
+				return migs.RoundTrip(cmd.Context(), db, config.opts.logger, config.scratchMigrationsOptions()...)
+			})
+			if err != nil {
+				return err
+			}
+
+			config.opts.logger.Printf("All migrations are reversible")
+
+			return nil
+		},
+	}
+
+	var statusOutput string
+	cmdStatus := &cobra.Command{
+		Use:   "status",
+		Short: "Show applied and pending migrations",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			migrations, err := migrations.MigrationsFromFS(os.DirFS(config.MigrationsDir()))
+			migs, err := config.Migrations(set)
 			if err != nil {
 				return err
 			}
@@ -66,15 +499,194 @@ func migrationsCommand(config *Config) *cobra.Command {
 				return err
 			}
 
-			return migrations.ApplyAll(db, config.opts.logger)
+			var status *migrations.Status
+			err = pgx.BeginFunc(cmd.Context(), db, func(tx pgx.Tx) error {
+				status, err = migs.Status(cmd.Context(), tx)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			switch statusOutput {
+			case "table":
+				return writeStatusTable(cmd.OutOrStdout(), status)
+			case "json":
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(status)
+			default:
+				return fmt.Errorf("Unknown output format: %q", statusOutput)
+			}
 		},
 	}
+	cmdStatus.Flags().StringVarP(&statusOutput, "output", "o", "table", "Output format (table or json)")
 
 	rootCmd := &cobra.Command{
 		Use:   "migrations",
 		Short: "Manage migrations",
 	}
+	rootCmd.PersistentFlags().StringVar(&set, "set", "", "Migration set to operate on (default set if empty)")
+
+	for _, cmd := range []*cobra.Command{cmdApply, cmdRevert, cmdVerify, cmdStatus, cmdGoto, cmdSquash, cmdDiff, cmdRoundTrip} {
+		cancelOnSignal(cmd, config.opts)
+	}
 
-	rootCmd.AddCommand(cmdNew, cmdApply, cmdRevert)
+	rootCmd.AddCommand(cmdNew, cmdApply, cmdRevert, cmdVerify, cmdStatus, cmdGoto, cmdLint, cmdRenumber, cmdSquash, cmdDiff, cmdRoundTrip)
 	return rootCmd
 }
+
+// Creates a scratch database next to the configured one for the duration of
+// fn. fn is given the connection parameters of the scratch database.
+func withScratchDB(ctx context.Context, config *Config, fn func(params *utils.ConnectionParams) error) error {
+	params := config.ConnParams()
+
+	db, err := pgx.Connect(ctx, params.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close(context.Background())
+
+	scratch := *params
+	scratch.Database = fmt.Sprintf("%s_scratch_%d", params.Database, time.Now().UnixNano())
+	ident := pgx.Identifier{scratch.Database}.Sanitize()
+
+	if _, err := db.Exec(ctx, `CREATE DATABASE `+ident); err != nil {
+		return err
+	}
+
+	defer func() {
+		if _, err := db.Exec(context.Background(), `DROP DATABASE `+ident); err != nil {
+			config.opts.logger.Printf("Failed to drop the scratch database %s: %v", ident, err)
+		}
+	}()
+
+	return fn(&scratch)
+}
+
+// Cancels the command's context on SIGINT and SIGTERM. Cancelling the context
+// aborts the running statement, and the open transaction is rolled back. The
+// logger is read from opts only when logging, as setupLogging may replace it
+// after the command is built.
+func cancelOnSignal(cmd *cobra.Command, opts *options) {
+	run := cmd.RunE
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		cmd.SetContext(ctx)
+
+		err := run(cmd, args)
+		if err != nil && ctx.Err() != nil {
+			opts.logger.Printf("Interrupted, the ongoing transaction was rolled back")
+		}
+
+		return err
+	}
+}
+
+func parseTransactionMode(mode string) (migrations.Option, error) {
+	switch mode {
+	case "single":
+		return migrations.OptionTransactionMode(migrations.TransactionSingle), nil
+	case "per-migration":
+		return migrations.OptionTransactionMode(migrations.TransactionPerMigration), nil
+	default:
+		return nil, fmt.Errorf("Unknown transaction mode: %q", mode)
+	}
+}
+
+// Writes the SQL that apply would run to file, or to stdout if file is empty.
+// The plans are resolved in a read-only transaction, and nothing is written
+// unless all of them resolve.
+func writeApplyPlan(cmd *cobra.Command, db *pgx.Conn, sets migrations.MigrationSets, file string, opts ...migrations.Option) error {
+	plans := make([]migrations.MigrationSlice, len(sets))
+	err := pgx.BeginTxFunc(cmd.Context(), db, pgx.TxOptions{AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		for i, set := range sets {
+			plan, err := set.Migrations.ApplyPlan(cmd.Context(), tx, opts...)
+			if err != nil {
+				return err
+			}
+
+			plans[i] = plan
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out := cmd.OutOrStdout()
+
+	var f *os.File
+	if file != "" {
+		f, err = os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		out = f
+	}
+
+	for i, set := range sets {
+		if len(plans[i]) > 0 && set.Name != "" {
+			fmt.Fprintf(out, "-- Migration set %s\n\n", set.Name)
+		}
+
+		if err := plans[i].WriteUpSQL(out); err != nil {
+			return err
+		}
+	}
+
+	if f != nil {
+		return f.Close()
+	}
+
+	return nil
+}
+
+func writeStatusTable(out io.Writer, status *migrations.Status) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "STATE\tMIGRATION\tAPPLIED AT\n")
+	for _, m := range status.Migrations {
+		state := "pending"
+		if m.Unknown {
+			state = "unknown"
+		} else if m.Applied {
+			state = "applied"
+		} else if m.OutOfOrder {
+			state = "out-of-order"
+		}
+
+		appliedAt := "-"
+		if m.AppliedAt != nil {
+			appliedAt = m.AppliedAt.Local().Format(time.DateTime)
+		}
+
+		name := m.Name
+		if name == "" {
+			name = fmt.Sprintf("%04d", m.Num)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\n", state, name, appliedAt)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if status.Set != "" {
+		fmt.Fprintf(out, "\nMigration set: %s", status.Set)
+	}
+
+	fmt.Fprintf(out, "\nCurrent version: %d (%d pending)\n", status.Version, len(status.Pending()))
+
+	for _, m := range status.Unknown() {
+		fmt.Fprintf(out, "WARNING: migration %d is applied to the database but missing from the migrations directory\n", m.Num)
+	}
+
+	return nil
+}
@@ -1,16 +1,20 @@
 package cli
 
 import (
+	"io/fs"
 	"log"
 
 	"github.com/vhakulinen/dino/db/migrations"
 )
 
 type options struct {
-	logger     migrations.Logger
-	cmdName    string
-	dbDriver   string
-	configFile string
+	logger       migrations.Logger
+	cmdName      string
+	dbDriver     string
+	configFile   string
+	migrationsFS fs.FS
+	hooks        []migrations.Hooks
+	events       migrations.EventHandler
 }
 
 func newOptions(opts ...option) *options {
@@ -58,3 +62,18 @@ func OptionConfigFile(f string) option {
 		opts.configFile = f
 	}
 }
+
+// Set the source of the migrations, e.g. an embed.FS. Overrides the
+// migrations directory. Migrations can't be created in the given source.
+func OptionMigrationsFS(source fs.FS) option {
+	return func(opts *options) {
+		opts.migrationsFS = source
+	}
+}
+
+// Add hooks called around migration runs and each migration.
+func OptionMigrationsHooks(hooks ...migrations.Hooks) option {
+	return func(opts *options) {
+		opts.hooks = append(opts.hooks, hooks...)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+
+	"github.com/vhakulinen/dino/db/migrations"
 )
 
 // New gives entry point for dino's cli.
@@ -18,9 +20,14 @@ func New(opts ...option) (*cobra.Command, *Config) {
 	rootCmd := &cobra.Command{
 		Use:          c.opts.cmdName,
 		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return c.setupLogging(cmd.ErrOrStderr())
+		},
 	}
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", c.opts.configFile, "Config file")
 
+	rootCmd.PersistentFlags().StringP("log-format", "", "text", "Log format (text or json)")
+
 	rootCmd.PersistentFlags().StringP("db-host", "", "localhost", "Database host")
 	rootCmd.PersistentFlags().IntP("db-port", "", 5432, "Database port")
 	rootCmd.PersistentFlags().StringP("db-username", "", "postgres", "Database username")
@@ -29,6 +36,13 @@ func New(opts ...option) (*cobra.Command, *Config) {
 	rootCmd.PersistentFlags().StringP("db-database", "", "postgres", "Database name")
 
 	rootCmd.PersistentFlags().StringP("migrations-dir", "", "migrations", "Directory where migrations are placed")
+	rootCmd.PersistentFlags().StringP("migrations-templates-dir", "", "", "Directory with up.sql and down.sql templates for new migrations")
+	rootCmd.PersistentFlags().StringSliceP("migrations-sets-order", "", nil, "Order in which migration sets are applied (the rest follow by name)")
+	rootCmd.PersistentFlags().StringP("migrations-versioning", "", "sequential", "Numbering of new migrations: sequential or timestamp")
+	rootCmd.PersistentFlags().BoolP("migrations-allow-out-of-order", "", false, "Apply pending migrations older than the latest applied one instead of failing")
+	rootCmd.PersistentFlags().Int64P("migrations-lock-key", "", migrations.DefaultLockKey, "Advisory lock key used while migrating")
+	rootCmd.PersistentFlags().DurationP("migrations-statement-timeout", "", 0, "Statement timeout used while migrating (0 uses the database default)")
+	rootCmd.PersistentFlags().DurationP("migrations-lock-timeout", "", migrations.DefaultLockTimeout, "How long to wait for the migrations lock (0 waits indefinitely)")
 
 	// Bind all the flags to viper and env.
 	rootCmd.PersistentFlags().VisitAll(func(flag *pflag.Flag) {
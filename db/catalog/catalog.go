@@ -0,0 +1,211 @@
+// Package catalog snapshots the schema of a database from its system catalog,
+// and compares snapshots.
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type ObjectKind string
+
+const (
+	KindTable      ObjectKind = "table"
+	KindColumn     ObjectKind = "column"
+	KindIndex      ObjectKind = "index"
+	KindConstraint ObjectKind = "constraint"
+	KindSequence   ObjectKind = "sequence"
+)
+
+// Object of the schema. Name is qualified with the schema, and columns and
+// constraints also with their table (e.g. public.users.id).
+type Object struct {
+	Kind       ObjectKind `json:"kind"`
+	Name       string     `json:"name"`
+	Definition string     `json:"definition"`
+}
+
+// Schema holds the objects of a database, ordered by kind and name.
+type Schema struct {
+	Objects []Object `json:"objects"`
+}
+
+type queryer interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// Filters out the system schemas and the tables tracking migrations. Expects
+// the schema to be aliased n and the table c.
+const userTables = `
+	n.nspname NOT IN ('pg_catalog', 'information_schema')
+	AND n.nspname NOT LIKE 'pg_toast%'
+	AND c.relname NOT IN ('schema_migrations', 'schema_repeatable_migrations')
+`
+
+var queries = map[ObjectKind]string{
+	KindTable: `
+		SELECT n.nspname || '.' || c.relname, ''
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND ` + userTables,
+	KindColumn: `
+		SELECT
+			n.nspname || '.' || c.relname || '.' || a.attname,
+			format_type(a.atttypid, a.atttypmod)
+				|| CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END
+				|| COALESCE(' DEFAULT ' || pg_get_expr(d.adbin, d.adrelid), '')
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attnum > 0 AND NOT a.attisdropped AND c.relkind IN ('r', 'p') AND ` + userTables,
+	KindIndex: `
+		SELECT n.nspname || '.' || i.relname, pg_get_indexdef(i.oid)
+		FROM pg_index x
+		JOIN pg_class i ON i.oid = x.indexrelid
+		JOIN pg_class c ON c.oid = x.indrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE ` + userTables,
+	KindConstraint: `
+		SELECT n.nspname || '.' || c.relname || '.' || con.conname, pg_get_constraintdef(con.oid)
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE ` + userTables,
+	KindSequence: `
+		SELECT
+			n.nspname || '.' || c.relname,
+			format('%s start %s increment %s min %s max %s%s',
+				format_type(s.seqtypid, NULL), s.seqstart, s.seqincrement, s.seqmin, s.seqmax,
+				CASE WHEN s.seqcycle THEN ' cycle' ELSE '' END)
+		FROM pg_sequence s
+		JOIN pg_class c ON c.oid = s.seqrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE ` + userTables,
+}
+
+// Snapshot reads the tables, columns, indexes, constraints and sequences of
+// the database. The tables tracking migrations are left out.
+func Snapshot(ctx context.Context, db queryer) (*Schema, error) {
+	schema := &Schema{}
+
+	for kind, query := range queries {
+		rows, err := db.Query(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to query %ss: %w", kind, err)
+		}
+
+		var name, definition string
+		_, err = pgx.ForEachRow(rows, []any{&name, &definition}, func() error {
+			schema.Objects = append(schema.Objects, Object{Kind: kind, Name: name, Definition: definition})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to query %ss: %w", kind, err)
+		}
+	}
+
+	sortObjects(schema.Objects)
+
+	return schema, nil
+}
+
+func sortObjects(objects []Object) {
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Kind != objects[j].Kind {
+			return objects[i].Kind < objects[j].Kind
+		}
+
+		return objects[i].Name < objects[j].Name
+	})
+}
+
+type ChangeKind string
+
+const (
+	// The object is in the expected schema only.
+	ChangeMissing ChangeKind = "missing"
+	// The object is in the actual schema only.
+	ChangeExtra ChangeKind = "extra"
+	// The object is in both, but its definition differs.
+	ChangeChanged ChangeKind = "changed"
+)
+
+// Difference between the expected and the actual schema.
+type Difference struct {
+	Change   ChangeKind `json:"change"`
+	Kind     ObjectKind `json:"kind"`
+	Name     string     `json:"name"`
+	Expected string     `json:"expected,omitempty"`
+	Actual   string     `json:"actual,omitempty"`
+}
+
+// Formats the difference as `- kind name: definition` for missing objects,
+// `+ kind name: definition` for extra ones, and `~ kind name: expected ->
+// actual` for changed ones. Tables have no definition.
+func (d Difference) String() string {
+	switch d.Change {
+	case ChangeMissing:
+		return fmt.Sprintf("- %s %s%s", d.Kind, d.Name, definition(d.Expected))
+	case ChangeExtra:
+		return fmt.Sprintf("+ %s %s%s", d.Kind, d.Name, definition(d.Actual))
+	default:
+		return fmt.Sprintf("~ %s %s: %s -> %s", d.Kind, d.Name, d.Expected, d.Actual)
+	}
+}
+
+func definition(s string) string {
+	if s == "" {
+		return ""
+	}
+
+	return ": " + s
+}
+
+// Diff returns the differences between the expected and the actual schema,
+// ordered by object kind and name.
+func Diff(expected, actual *Schema) []Difference {
+	type key struct {
+		kind ObjectKind
+		name string
+	}
+
+	remaining := make(map[key]Object, len(actual.Objects))
+	for _, o := range actual.Objects {
+		remaining[key{o.Kind, o.Name}] = o
+	}
+
+	var diffs []Difference
+	for _, e := range expected.Objects {
+		k := key{e.Kind, e.Name}
+
+		a, ok := remaining[k]
+		if !ok {
+			diffs = append(diffs, Difference{Change: ChangeMissing, Kind: e.Kind, Name: e.Name, Expected: e.Definition})
+			continue
+		}
+
+		delete(remaining, k)
+
+		if a.Definition != e.Definition {
+			diffs = append(diffs, Difference{Change: ChangeChanged, Kind: e.Kind, Name: e.Name, Expected: e.Definition, Actual: a.Definition})
+		}
+	}
+
+	for _, a := range remaining {
+		diffs = append(diffs, Difference{Change: ChangeExtra, Kind: a.Kind, Name: a.Name, Actual: a.Definition})
+	}
+
+	sort.SliceStable(diffs, func(i, j int) bool {
+		if diffs[i].Kind != diffs[j].Kind {
+			return diffs[i].Kind < diffs[j].Kind
+		}
+
+		return diffs[i].Name < diffs[j].Name
+	})
+
+	return diffs
+}
@@ -0,0 +1,57 @@
+package catalog_test
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/vhakulinen/dino/db/catalog"
+)
+
+func TestDiff(t *testing.T) {
+	expected := &catalog.Schema{Objects: []catalog.Object{
+		{Kind: catalog.KindColumn, Name: "public.users.email", Definition: "text NOT NULL"},
+		{Kind: catalog.KindColumn, Name: "public.users.id", Definition: "integer NOT NULL"},
+		{Kind: catalog.KindIndex, Name: "public.users_email_idx", Definition: "CREATE INDEX users_email_idx ON public.users USING btree (email)"},
+		{Kind: catalog.KindTable, Name: "public.users"},
+	}}
+
+	actual := &catalog.Schema{Objects: []catalog.Object{
+		{Kind: catalog.KindColumn, Name: "public.users.email", Definition: "text"},
+		{Kind: catalog.KindColumn, Name: "public.users.id", Definition: "integer NOT NULL"},
+		{Kind: catalog.KindIndex, Name: "public.users_hotfix_idx", Definition: "CREATE INDEX users_hotfix_idx ON public.users USING btree (id)"},
+		{Kind: catalog.KindTable, Name: "public.users"},
+	}}
+
+	got := catalog.Diff(expected, actual)
+
+	want := []catalog.Difference{{
+		Change:   catalog.ChangeChanged,
+		Kind:     catalog.KindColumn,
+		Name:     "public.users.email",
+		Expected: "text NOT NULL",
+		Actual:   "text",
+	}, {
+		Change:   catalog.ChangeMissing,
+		Kind:     catalog.KindIndex,
+		Name:     "public.users_email_idx",
+		Expected: "CREATE INDEX users_email_idx ON public.users USING btree (email)",
+	}, {
+		Change: catalog.ChangeExtra,
+		Kind:   catalog.KindIndex,
+		Name:   "public.users_hotfix_idx",
+		Actual: "CREATE INDEX users_hotfix_idx ON public.users USING btree (id)",
+	}}
+
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Fatal(diff)
+	}
+
+	if s := got[0].String(); s != "~ column public.users.email: text NOT NULL -> text" {
+		t.Fatalf("Unexpected string: %q", s)
+	}
+
+	if diffs := catalog.Diff(expected, expected); len(diffs) != 0 {
+		t.Fatalf("Expected no differences, got %v", diffs)
+	}
+}
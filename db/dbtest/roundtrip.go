@@ -0,0 +1,31 @@
+package dbtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/vhakulinen/dino/db/migrations"
+)
+
+// Checks that the migrations are reversible by applying, reverting and
+// re-applying each pending migration in db, see MigrationSlice.RoundTrip.
+// Fails the test, naming the migration that is not reversible, otherwise.
+func RoundTrip(t *testing.T, ctx context.Context, db *pgxpool.Pool, migs migrations.MigrationSlice, opts ...migrations.Option) {
+	t.Helper()
+
+	if err := migs.RoundTrip(ctx, db, testLogger{t}, opts...); err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+}
+
+// Logs to the test's log.
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Printf(template string, args ...interface{}) {
+	l.t.Helper()
+	l.t.Logf(template, args...)
+}
@@ -23,6 +23,8 @@ var cleanRegexps = []*regexp.Regexp{
 	regexp.MustCompile(`(?m)^SET .*;$`),
 	// Comments.
 	regexp.MustCompile(`(?m)^--.*$`),
+	// psql meta-commands (e.g. \restrict), which can't be run as SQL.
+	regexp.MustCompile(`(?m)^\\.*$`),
 	// Empty lines.
 	regexp.MustCompile(`(?m)^\n`),
 }
@@ -50,19 +52,41 @@ func LoadFixture(ctx context.Context, conn fixtureDB, fixture string) error {
 }
 
 func DumpFixture(opts *utils.ConnectionParams) ([]byte, error) {
-	cmd := exec.Command(
-		"pg_dump",
-		"-h", opts.Host,
-		"-p", strconv.Itoa(opts.Port),
-		"-d", opts.Database,
-		"-U", opts.Username,
+	return pgDump(
+		opts,
 		"--data-only",
-		// Exlcude schema_version table.
-		"--exclude-table", "schema_version",
+		// Exlcude schema_migrations table.
+		"--exclude-table", "schema_migrations",
+		"--exclude-table", "schema_repeatable_migrations",
 		// Don't do each row in their own INSERT.
 		"--rows-per-insert", "1000",
 		"--column-inserts",
 	)
+}
+
+// Dumps the schema of the database without the migration tracking tables,
+// ownership or privileges.
+func DumpSchema(opts *utils.ConnectionParams) ([]byte, error) {
+	return pgDump(
+		opts,
+		"--schema-only",
+		"--exclude-table", "schema_migrations",
+		"--exclude-table", "schema_repeatable_migrations",
+		"--no-owner",
+		"--no-privileges",
+	)
+}
+
+func pgDump(opts *utils.ConnectionParams, args ...string) ([]byte, error) {
+	cmd := exec.Command(
+		"pg_dump",
+		append([]string{
+			"-h", opts.Host,
+			"-p", strconv.Itoa(opts.Port),
+			"-d", opts.Database,
+			"-U", opts.Username,
+		}, args...)...,
+	)
 	cmd.Env = []string{"PGPASSWORD=" + opts.Password}
 
 	// Output errors to stderr.
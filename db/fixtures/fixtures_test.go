@@ -122,3 +122,39 @@ func TestLoadFixture(t *testing.T) {
 	}
 
 }
+
+func TestDumpSchema(t *testing.T) {
+	ctx := context.Background()
+	connParams := dbtest.DefaultConnectionParams
+	dbname := strings.ToLower(t.Name())
+
+	params := dbtest.WithCreateDB(t, ctx, &connParams, dbname)
+	db := dbtest.OpenDB(t, ctx, params)
+
+	_, err := db.Exec(ctx, `
+	CREATE TABLE foo (
+		id SERIAL PRIMARY KEY,
+		name TEXT
+	);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dump, err := fixtures.DumpSchema(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Session settings would outlive the baseline migration running the
+	// dump, and meta-commands are not SQL.
+	for _, line := range strings.Split(string(dump), "\n") {
+		if strings.HasPrefix(line, "SET ") || strings.Contains(line, "set_config") || strings.HasPrefix(line, `\`) {
+			t.Errorf("Unexpected line in the dump: %s", line)
+		}
+	}
+
+	if !strings.Contains(string(dump), "CREATE TABLE public.foo") {
+		t.Errorf("Expected the dump to create foo, got:\n%s", dump)
+	}
+}
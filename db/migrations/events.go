@@ -0,0 +1,140 @@
+package migrations
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+type EventKind string
+
+const (
+	EventMigrationStarted  EventKind = "migration_started"
+	EventMigrationFinished EventKind = "migration_finished"
+	EventMigrationFailed   EventKind = "migration_failed"
+)
+
+// Event reports the progress of applying or reverting a migration.
+//
+// A finished migration that shares its transaction with other migrations (see
+// TransactionSingle) is still rolled back if a later one fails.
+type Event struct {
+	Kind          EventKind
+	Set           string
+	Name          string
+	Num           int
+	Down          bool
+	NoTransaction bool
+	// Number of statements in the script run. Zero for Go migrations.
+	Statements int
+	// Set for finished and failed migrations.
+	Duration time.Duration
+	// Set for failed migrations.
+	Err error
+}
+
+// EventHandler receives the events of migration runs. It's called
+// synchronously, so it should not block.
+type EventHandler func(Event)
+
+// LoggerEvents returns an EventHandler that writes the events to logger as
+// text, e.g. "Applying '0001_20240101_1200_users'...".
+func LoggerEvents(logger Logger) EventHandler {
+	return func(e Event) {
+		action, done := "Applying", "Applied"
+		if e.Down {
+			action, done = "Reverting", "Reverted"
+		}
+
+		switch e.Kind {
+		case EventMigrationStarted:
+			if e.NoTransaction {
+				logger.Printf("%s '%s' outside a transaction...", action, e.Name)
+			} else {
+				logger.Printf("%s '%s'...", action, e.Name)
+			}
+		case EventMigrationFinished:
+			logger.Printf("%s '%s' in %s", done, e.Name, e.Duration)
+		case EventMigrationFailed:
+			logger.Printf("%s '%s' failed after %s: %v", action, e.Name, e.Duration, e.Err)
+		}
+	}
+}
+
+var eventMessages = map[EventKind]string{
+	EventMigrationStarted:  "Migration started",
+	EventMigrationFinished: "Migration finished",
+	EventMigrationFailed:   "Migration failed",
+}
+
+// SlogEvents returns an EventHandler that writes the events to logger as
+// structured records. Failures are logged at the error level, the rest at the
+// info level.
+func SlogEvents(logger *slog.Logger) EventHandler {
+	return func(e Event) {
+		attrs := []slog.Attr{
+			slog.String("event", string(e.Kind)),
+			slog.String("set", e.Set),
+			slog.String("name", e.Name),
+			slog.Int("num", e.Num),
+			slog.Bool("down", e.Down),
+			slog.Bool("no_transaction", e.NoTransaction),
+			slog.Int("statements", e.Statements),
+		}
+
+		level := slog.LevelInfo
+		if e.Kind != EventMigrationStarted {
+			attrs = append(attrs, slog.Duration("duration", e.Duration))
+		}
+
+		if e.Err != nil {
+			level = slog.LevelError
+			attrs = append(attrs, slog.String("error", e.Err.Error()))
+		}
+
+		logger.LogAttrs(context.Background(), level, eventMessages[e.Kind], attrs...)
+	}
+}
+
+// Returns the event of the step, with Kind, Duration and Err unset.
+func (s step) event() Event {
+	e := Event{
+		Set:           s.m.Set,
+		Name:          s.m.Name,
+		Num:           s.m.Num,
+		Down:          s.down,
+		NoTransaction: s.m.NoTransaction,
+	}
+
+	script, fn := s.m.Up, s.m.UpFunc
+	if s.down {
+		script, fn = s.m.Down, s.m.DownFunc
+	}
+
+	if fn == nil {
+		e.Statements = len(splitStatements(script))
+	}
+
+	return e
+}
+
+// Runs fn, emitting the started event of the step before it, and the finished
+// or failed event after it.
+func (s step) track(o *options, fn func() error) error {
+	e := s.event()
+	e.Kind = EventMigrationStarted
+	o.emit(e)
+
+	start := time.Now()
+	err := fn()
+
+	e.Kind = EventMigrationFinished
+	e.Duration = time.Since(start)
+	if err != nil {
+		e.Kind = EventMigrationFailed
+		e.Err = err
+	}
+	o.emit(e)
+
+	return err
+}
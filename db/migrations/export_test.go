@@ -0,0 +1,10 @@
+package migrations
+
+// Forgets the registered Go migrations, so tests can register theirs without
+// leaking them into other tests.
+func ResetRegistry() {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry = nil
+}
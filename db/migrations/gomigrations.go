@@ -0,0 +1,71 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Migration implemented in Go, for changes that are impractical in SQL.
+type GoMigrationFunc func(ctx context.Context, tx pgx.Tx) error
+
+var (
+	registryMu sync.Mutex
+	registry   MigrationSlice
+)
+
+// Register registers a Go migration. The name must follow the same
+// NNNN_YYYYMMDD_HHMM_name format as migration directories. Registered
+// migrations are returned by Registered, and can be merged with the ones from
+// MigrationsFromFS.
+//
+// Register is meant to be called from init functions, and panics if the name
+// is malformed or already registered.
+func Register(name string, up, down GoMigrationFunc) {
+	num, err := parseMigrationName(name)
+	if err != nil {
+		panic(fmt.Sprintf("migrations: Register %q: %v", name, err))
+	}
+
+	if up == nil || down == nil {
+		panic(fmt.Sprintf("migrations: Register %q: up and down must not be nil", name))
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for _, m := range registry {
+		if m.Name == name {
+			panic(fmt.Sprintf("migrations: Register called twice for %q", name))
+		}
+	}
+
+	registry = append(registry, &Migration{
+		Name:     name,
+		Num:      num,
+		UpFunc:   up,
+		DownFunc: down,
+	})
+}
+
+// Returns the registered Go migrations, ordered by number.
+func Registered() MigrationSlice {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	return MigrationSlice(nil).Merge(registry)
+}
+
+// Merge returns a new slice with the migrations of both slices, ordered by
+// number and followed by the repeatable migrations.
+func (slice MigrationSlice) Merge(other MigrationSlice) MigrationSlice {
+	merged := make(MigrationSlice, 0, len(slice)+len(other))
+	merged = append(merged, slice...)
+	merged = append(merged, other...)
+
+	sortMigrations(merged)
+
+	return merged
+}
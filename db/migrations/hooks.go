@@ -0,0 +1,110 @@
+package migrations
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RunInfo describes a run of ApplyAll, MigrateTo or RevertSteps.
+type RunInfo struct {
+	Set string
+	// Migrations to be applied or reverted, in order. MigrateTo may both
+	// revert and apply migrations in a single run.
+	Migrations MigrationSlice
+	// Down is set for runs of RevertSteps.
+	Down  bool
+	Start time.Time
+	// Duration of the run, set for AfterRun.
+	Duration time.Duration
+}
+
+// MigrationInfo describes a migration being applied or reverted.
+type MigrationInfo struct {
+	Down  bool
+	Start time.Time
+	// Duration of applying or reverting the migration, set for
+	// AfterMigration.
+	Duration time.Duration
+}
+
+// Hooks are called around migration runs and each migration, e.g. to refresh
+// materialized views or to send notifications. Returning an error aborts the
+// run, and the transaction the hook was given is rolled back.
+//
+// The hooks of a migration are given the migration's transaction. Migrations
+// run outside a transaction get a transaction of their own for each hook.
+// BeforeRun is given the transaction used to plan the run, and AfterRun a
+// transaction of its own after the migrations are committed, except for
+// RevertSteps, which uses the caller's transaction throughout.
+//
+// Embed NoopHooks to implement only some of the hooks.
+type Hooks interface {
+	BeforeRun(ctx context.Context, tx pgx.Tx, run *RunInfo) error
+	AfterRun(ctx context.Context, tx pgx.Tx, run *RunInfo) error
+	BeforeMigration(ctx context.Context, tx pgx.Tx, m *Migration, info MigrationInfo) error
+	AfterMigration(ctx context.Context, tx pgx.Tx, m *Migration, info MigrationInfo) error
+}
+
+// NoopHooks implements Hooks by doing nothing.
+type NoopHooks struct{}
+
+func (NoopHooks) BeforeRun(ctx context.Context, tx pgx.Tx, run *RunInfo) error {
+	return nil
+}
+
+func (NoopHooks) AfterRun(ctx context.Context, tx pgx.Tx, run *RunInfo) error {
+	return nil
+}
+
+func (NoopHooks) BeforeMigration(ctx context.Context, tx pgx.Tx, m *Migration, info MigrationInfo) error {
+	return nil
+}
+
+func (NoopHooks) AfterMigration(ctx context.Context, tx pgx.Tx, m *Migration, info MigrationInfo) error {
+	return nil
+}
+
+// Calls the hooks in order, stopping at the first error.
+type hookList []Hooks
+
+func (l hookList) beforeRun(ctx context.Context, tx pgx.Tx, run *RunInfo) error {
+	for _, h := range l {
+		if err := h.BeforeRun(ctx, tx, run); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l hookList) afterRun(ctx context.Context, tx pgx.Tx, run *RunInfo) error {
+	for _, h := range l {
+		if err := h.AfterRun(ctx, tx, run); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l hookList) beforeMigration(ctx context.Context, tx pgx.Tx, m *Migration, info MigrationInfo) error {
+	for _, h := range l {
+		if err := h.BeforeMigration(ctx, tx, m, info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l hookList) afterMigration(ctx context.Context, tx pgx.Tx, m *Migration, info MigrationInfo) error {
+	for _, h := range l {
+		if err := h.AfterMigration(ctx, tx, m, info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,472 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ProblemKind string
+
+const (
+	ProblemDuplicate   ProblemKind = "duplicate"
+	ProblemGap         ProblemKind = "gap"
+	ProblemJunk        ProblemKind = "junk"
+	ProblemMissingFile ProblemKind = "missing-file"
+	ProblemName        ProblemKind = "name"
+	ProblemSet         ProblemKind = "set"
+	ProblemFormat      ProblemKind = "format"
+	ProblemEmptyDown   ProblemKind = "empty-down"
+)
+
+// Problem found in the migrations.
+type Problem struct {
+	Kind    ProblemKind
+	Path    string
+	Message string
+	// Warnings point out likely mistakes that don't prevent applying the
+	// migrations, e.g. an empty down script.
+	Warning bool
+}
+
+func (p Problem) String() string {
+	if p.Warning {
+		return fmt.Sprintf("%s: warning: %s", p.Path, p.Message)
+	}
+
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// ValidationError lists all the problems found in the migrations.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%d problem(s) found in migrations:", len(e.Problems))
+	for _, p := range e.Problems {
+		fmt.Fprintf(&b, "\n  %s", p)
+	}
+
+	return b.String()
+}
+
+// SplitWarnings returns the warnings of e, and a *ValidationError with the
+// rest of the problems, or nil if there are none.
+func (e *ValidationError) SplitWarnings() ([]Problem, error) {
+	var warnings, problems []Problem
+	for _, p := range e.Problems {
+		if p.Warning {
+			warnings = append(warnings, p)
+		} else {
+			problems = append(problems, p)
+		}
+	}
+
+	if len(problems) == 0 {
+		return warnings, nil
+	}
+
+	return warnings, &ValidationError{Problems: problems}
+}
+
+// Marks the migration directory holding it as irreversible. Its contents,
+// e.g. an explanation, are ignored.
+const irreversibleFile = "irreversible"
+
+// Files expected in a migration directory.
+var migrationFiles = map[string]bool{
+	"up.sql":         true,
+	"down.sql":       true,
+	irreversibleFile: true,
+}
+
+// Validate checks the migrations for duplicate numbers and gaps in the
+// sequential numbering (timestamp numbers are not checked for gaps), and that
+// they all belong to the same migration set. Returns *ValidationError if any
+// problems are found.
+func (slice MigrationSlice) Validate() error {
+	problems := slice.numberingProblems()
+
+	for _, m := range slice {
+		if m.Set != slice.set() {
+			problems = append(problems, Problem{
+				Kind:    ProblemSet,
+				Path:    m.Name,
+				Message: fmt.Sprintf("belongs to migration set %q instead of %q", m.Set, slice.set()),
+			})
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+
+	return nil
+}
+
+func (slice MigrationSlice) numberingProblems() []Problem {
+	var problems []Problem
+
+	byNum := make(map[int][]string)
+	baselines := make(map[int]bool)
+	for _, m := range slice.numbered() {
+		byNum[m.Num] = append(byNum[m.Num], m.Name)
+		if m.Baseline {
+			baselines[m.Num] = true
+		}
+	}
+
+	nums := make([]int, 0, len(byNum))
+	for num := range byNum {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	expected := 1
+	for _, num := range nums {
+		names := byNum[num]
+		if len(names) > 1 {
+			for _, name := range names {
+				problems = append(problems, Problem{
+					Kind:    ProblemDuplicate,
+					Path:    name,
+					Message: fmt.Sprintf("migration number %d is used by %d migrations", num, len(names)),
+				})
+			}
+		}
+
+		// Timestamps are expected to have gaps.
+		if isTimestampNum(num) {
+			continue
+		}
+
+		// The migrations before a baseline are archived.
+		if baselines[num] {
+			expected = num
+		}
+
+		if num > expected {
+			missing := strconv.Itoa(expected)
+			if num-1 > expected {
+				missing = fmt.Sprintf("%d-%d", expected, num-1)
+			}
+
+			problems = append(problems, Problem{
+				Kind:    ProblemGap,
+				Path:    names[0],
+				Message: fmt.Sprintf("migration(s) %s missing before this migration", missing),
+			})
+		}
+
+		expected = num + 1
+	}
+
+	return problems
+}
+
+// Reports whether num is a timestamp, as used with VersioningTimestamp.
+func isTimestampNum(num int) bool {
+	_, err := time.Parse(timestampFormat, strconv.Itoa(num))
+	return err == nil
+}
+
+// LintFS checks the layout of the migrations directory, including the
+// migration sets in its subdirectories, in addition to the checks done by
+// Validate. Returns *ValidationError if any problems, including warnings, are
+// found. Extra migrations (e.g. Go migrations) are taken into account when
+// checking the numbering of their sets.
+//
+// Hidden files (e.g. .gitkeep) are ignored.
+func LintFS(source fs.FS, extra ...*Migration) error {
+	sets := make(map[string]MigrationSlice)
+	for _, m := range extra {
+		sets[m.Set] = append(sets[m.Set], m)
+	}
+
+	problems, err := lintSetDir(source, ".", "", sets)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(sets))
+	for name := range sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		problems = append(problems, sets[name].numberingProblems()...)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+
+	return nil
+}
+
+// Lints the migration set in dir and the sets in its subdirectories. The
+// migrations found are added to sets.
+func lintSetDir(source fs.FS, dir, set string, sets map[string]MigrationSlice) ([]Problem, error) {
+	entries, err := fs.ReadDir(source, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	for _, entry := range entries {
+		name := entry.Name()
+		entryPath := path.Join(dir, name)
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		if !entry.IsDir() && isMigrationFile(name) {
+			fileProblems, err := lintMigrationFile(source, entryPath)
+			if err != nil {
+				return nil, err
+			}
+			problems = append(problems, fileProblems...)
+
+			if num, err := parseMigrationName(strings.TrimSuffix(name, ".sql")); err == nil {
+				sets[set] = append(sets[set], &Migration{
+					Name:     entryPath,
+					Num:      num,
+					Set:      set,
+					Baseline: isBaselinePath(source, entryPath, false),
+				})
+			}
+			continue
+		}
+
+		if !entry.IsDir() {
+			problems = append(problems, Problem{
+				Kind:    ProblemJunk,
+				Path:    entryPath,
+				Message: "not a migration directory or file",
+			})
+			continue
+		}
+
+		if name == repeatableDir {
+			repeatableProblems, err := lintRepeatableDir(source, entryPath)
+			if err != nil {
+				return nil, err
+			}
+
+			problems = append(problems, repeatableProblems...)
+			continue
+		}
+
+		isMigration, err := isMigrationDir(source, entryPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isMigration {
+			setProblems, err := lintSetDir(source, entryPath, entryPath, sets)
+			if err != nil {
+				return nil, err
+			}
+
+			problems = append(problems, setProblems...)
+			continue
+		}
+
+		dirProblems, err := lintMigrationDir(source, entryPath)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, dirProblems...)
+
+		if num, err := parseMigrationName(name); err == nil {
+			sets[set] = append(sets[set], &Migration{
+				Name:     entryPath,
+				Num:      num,
+				Set:      set,
+				Baseline: isBaselinePath(source, entryPath, true),
+			})
+		}
+	}
+
+	return problems, nil
+}
+
+// Reports whether the migration directory or single file migration at p is a
+// baseline. Unreadable and malformed migrations are reported by the other
+// checks.
+func isBaselinePath(source fs.FS, p string, isDir bool) bool {
+	if isDir {
+		up, err := readFile(source, path.Join(p, "up.sql"))
+		return err == nil && hasBaselineDirective(string(up))
+	}
+
+	contents, err := readFile(source, p)
+	if err != nil {
+		return false
+	}
+
+	preamble, up, _, err := splitSections(string(contents))
+	return err == nil && (hasBaselineDirective(preamble) || hasBaselineDirective(up))
+}
+
+func lintRepeatableDir(source fs.FS, dirname string) ([]Problem, error) {
+	entries, err := fs.ReadDir(source, dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			problems = append(problems, Problem{
+				Kind:    ProblemJunk,
+				Path:    path.Join(dirname, entry.Name()),
+				Message: "not a repeatable migration",
+			})
+		}
+	}
+
+	return problems, nil
+}
+
+func lintMigrationDir(source fs.FS, dirname string) ([]Problem, error) {
+	var problems []Problem
+
+	if _, err := parseMigrationName(path.Base(dirname)); err != nil {
+		problems = append(problems, Problem{
+			Kind:    ProblemName,
+			Path:    dirname,
+			Message: err.Error(),
+		})
+	}
+
+	entries, err := fs.ReadDir(source, dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		if entry.IsDir() || !migrationFiles[entry.Name()] {
+			problems = append(problems, Problem{
+				Kind:    ProblemJunk,
+				Path:    path.Join(dirname, entry.Name()),
+				Message: "unexpected file in migration directory",
+			})
+			continue
+		}
+
+		found[entry.Name()] = true
+	}
+
+	for _, fname := range []string{"up.sql", "down.sql"} {
+		if !found[fname] {
+			problems = append(problems, Problem{
+				Kind:    ProblemMissingFile,
+				Path:    path.Join(dirname, fname),
+				Message: "file is missing",
+			})
+		}
+	}
+
+	if found["down.sql"] && !found[irreversibleFile] {
+		down, err := readFile(source, path.Join(dirname, "down.sql"))
+		if err != nil {
+			return nil, err
+		}
+
+		if isEmptyScript(string(down)) && !hasIrreversibleDirective(string(down)) {
+			problems = append(problems, Problem{
+				Kind:    ProblemEmptyDown,
+				Path:    path.Join(dirname, "down.sql"),
+				Message: "down.sql is empty, add an irreversible file or -- dino:irreversible to it if the migration cannot be reverted",
+				Warning: true,
+			})
+		}
+	}
+
+	return problems, nil
+}
+
+func lintMigrationFile(source fs.FS, fname string) ([]Problem, error) {
+	var problems []Problem
+
+	if _, err := parseMigrationName(strings.TrimSuffix(path.Base(fname), ".sql")); err != nil {
+		problems = append(problems, Problem{
+			Kind:    ProblemName,
+			Path:    fname,
+			Message: err.Error(),
+		})
+	}
+
+	contents, err := readFile(source, fname)
+	if err != nil {
+		return nil, err
+	}
+
+	preamble, _, down, err := splitSections(string(contents))
+	if err != nil {
+		problems = append(problems, Problem{
+			Kind:    ProblemFormat,
+			Path:    fname,
+			Message: err.Error(),
+		})
+	} else if isEmptyScript(down) && !hasIrreversibleDirective(preamble) && !hasIrreversibleDirective(down) {
+		problems = append(problems, Problem{
+			Kind:    ProblemEmptyDown,
+			Path:    fname,
+			Message: "down section is empty, add -- dino:irreversible to it if the migration cannot be reverted",
+			Warning: true,
+		})
+	}
+
+	return problems, nil
+}
+
+// Reports whether the script has nothing but comments and whitespace.
+func isEmptyScript(script string) bool {
+	return strings.TrimSpace(stripComments(script)) == ""
+}
+
+// Parses the migration number from a name in the NNNN_YYYYMMDD_HHMM_name
+// format.
+func parseMigrationName(name string) (int, error) {
+	parts := strings.SplitN(name, "_", 4)
+	if len(parts) < 4 || parts[3] == "" {
+		return 0, errors.New("name does not match the NNNN_YYYYMMDD_HHMM_name format")
+	}
+
+	for _, r := range parts[0] {
+		if r < '0' || r > '9' {
+			return 0, fmt.Errorf("invalid migration number %q", parts[0])
+		}
+	}
+
+	num, err := strconv.Atoi(parts[0])
+	if err != nil || num < 1 {
+		return 0, fmt.Errorf("invalid migration number %q", parts[0])
+	}
+
+	if _, err := time.Parse(format, parts[1]+"_"+parts[2]); err != nil {
+		return 0, fmt.Errorf("invalid date %q", parts[1]+"_"+parts[2])
+	}
+
+	return num, nil
+}
@@ -0,0 +1,133 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const lockPollInterval = 500 * time.Millisecond
+
+type queryer interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// Lock acquires the advisory lock that ApplyAll, MigrateTo and RevertSteps
+// hold while migrating. The lock is released when tx ends.
+func Lock(ctx context.Context, tx pgx.Tx, opts ...Option) error {
+	return acquireLock(ctx, tx, newOptions(opts...))
+}
+
+// Acquires the transaction level advisory lock, so only one process migrates
+// the database at a time. The lock is released when tx ends.
+func acquireLock(ctx context.Context, tx pgx.Tx, opts *options) error {
+	return waitForLock(ctx, tx, `SELECT pg_try_advisory_xact_lock($1)`, opts)
+}
+
+// Pins db to a single connection and holds the session level advisory lock on
+// it while fn runs. Session level lock is needed, because migrations marked
+// with NoTransaction are run outside of transactions.
+func withLockedConn(ctx context.Context, db applyDB, opts *options, fn func(conn applyDB) error) error {
+	if pool, ok := db.(acquirer); ok {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Release()
+
+		db = conn
+	}
+
+	if err := waitForLock(ctx, db, `SELECT pg_try_advisory_lock($1)`, opts); err != nil {
+		return err
+	}
+
+	err := setStatementTimeout(ctx, db, opts.statementTimeout, false)
+	if err == nil {
+		err = fn(db)
+	}
+
+	// Don't leak the timeout to pooled connections.
+	if opts.statementTimeout > 0 {
+		if _, resetErr := db.Exec(context.Background(), `RESET statement_timeout`); resetErr != nil && err == nil {
+			err = resetErr
+		}
+	}
+
+	// Use a fresh context, so the lock is released even if ctx was cancelled.
+	if _, unlockErr := db.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, opts.lockKey); unlockErr != nil {
+		opts.logger.Printf("Failed to release the migrations lock: %v", unlockErr)
+		if err == nil {
+			err = unlockErr
+		}
+	}
+
+	return err
+}
+
+func waitForLock(ctx context.Context, db queryer, query string, opts *options) error {
+	ok, err := tryLock(ctx, db, query, opts.lockKey)
+	if err != nil || ok {
+		return err
+	}
+
+	opts.logger.Printf("Waiting for the migrations lock (key %d)...", opts.lockKey)
+
+	var deadline <-chan time.Time
+	if opts.lockTimeout > 0 {
+		timer := time.NewTimer(opts.lockTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return fmt.Errorf("Timed out after %s waiting for the migrations lock (key %d)", opts.lockTimeout, opts.lockKey)
+		case <-ticker.C:
+		}
+
+		ok, err := tryLock(ctx, db, query, opts.lockKey)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			opts.logger.Printf("Acquired the migrations lock")
+			return nil
+		}
+	}
+}
+
+func tryLock(ctx context.Context, db queryer, query string, key int64) (bool, error) {
+	rows, err := db.Query(ctx, query, key)
+	if err != nil {
+		return false, err
+	}
+
+	return pgx.CollectOneRow(rows, pgx.RowTo[bool])
+}
+
+// Sets statement_timeout for the session, or for the current transaction if
+// local is true. Non-positive d is a no-op.
+func setStatementTimeout(ctx context.Context, db queryer, d time.Duration, local bool) error {
+	if d <= 0 {
+		return nil
+	}
+
+	rows, err := db.Query(ctx, `SELECT set_config('statement_timeout', $1, $2)`, strconv.FormatInt(d.Milliseconds(), 10), local)
+	if err != nil {
+		return err
+	}
+
+	_, err = pgx.CollectOneRow(rows, pgx.RowTo[string])
+	return err
+}
@@ -2,19 +2,31 @@ package migrations
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 const format = "20060102_1504"
 
+// Subdirectory of a migration set's directory holding its repeatable
+// migrations.
+const repeatableDir = "repeatable"
+
+// Format of the migration numbers with VersioningTimestamp.
+const timestampFormat = "20060102150405"
+
 type Logger interface {
 	Printf(template string, args ...interface{})
 }
@@ -24,81 +36,401 @@ type Migration struct {
 	Num  int
 	Up   string
 	Down string
+	// Set is the name of the migration set the migration belongs to. Empty
+	// for the default set.
+	Set string
+	// NoTransaction is set for migrations that must be run outside a
+	// transaction (e.g. CREATE INDEX CONCURRENTLY). Enabled by having
+	// `-- dino:no-transaction` in the leading comments of up.sql or down.sql.
+	NoTransaction bool
+	// Baseline is set for migrations that replace all the migrations before
+	// them, see Squash. Enabled by having `-- dino:baseline` in the leading
+	// comments of up.sql.
+	Baseline bool
+	// Irreversible is set for migrations that cannot be reverted (e.g. ones
+	// dropping columns with data). Enabled by an `irreversible` file in the
+	// migration directory, or by having `-- dino:irreversible` in the leading
+	// comments of down.sql or of the down section of a single file migration.
+	Irreversible bool
+	// Repeatable is set for migrations read from the repeatable subdirectory
+	// (e.g. views and functions defined with CREATE OR REPLACE). They have no
+	// number or down script, and are re-run by ApplyAll whenever Up changes.
+	Repeatable bool
+	// UpFunc and DownFunc are set for Go migrations (see Register), and are
+	// run instead of Up and Down.
+	UpFunc   GoMigrationFunc
+	DownFunc GoMigrationFunc
 }
 
+// MigrationSlice holds the migrations of a single migration set. Repeatable
+// migrations come after the numbered ones.
 type MigrationSlice []*Migration
 
+// Reads the migrations of the default set from the root of source.
+// Subdirectories holding other migration sets are skipped, see
+// MigrationSetsFromFS.
 func MigrationsFromFS(source fs.FS) (MigrationSlice, error) {
-	files, err := fs.ReadDir(source, ".")
+	migrations, _, err := migrationsFromDir(source, ".", "")
+	return migrations, err
+}
+
+// Reads the migrations from dir, and returns them along with the
+// subdirectories that hold migration sets.
+func migrationsFromDir(source fs.FS, dir, set string) (MigrationSlice, []string, error) {
+	files, err := fs.ReadDir(source, dir)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	var dirs []string
+	var migrations MigrationSlice
+	var setDirs []string
 	for _, file := range files {
-		if file.Type().IsDir() {
-			dirs = append(dirs, file.Name())
+		name := file.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
 		}
-	}
 
-	migrations := make(MigrationSlice, len(dirs))
-	for i, dirname := range dirs {
-		up, err := readFile(source, fmt.Sprintf("%s/up.sql", dirname))
-		if err != nil {
-			return nil, err
+		if !file.Type().IsDir() {
+			if !isMigrationFile(name) {
+				continue
+			}
+
+			m, err := migrationFromFile(source, dir, name)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			m.Set = set
+			migrations = append(migrations, m)
+			continue
+		}
+
+		if name == repeatableDir {
+			repeatable, err := repeatableMigrationsFromDir(source, path.Join(dir, name))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			for _, m := range repeatable {
+				m.Set = set
+			}
+
+			migrations = append(migrations, repeatable...)
+			continue
 		}
 
-		down, err := readFile(source, fmt.Sprintf("%s/down.sql", dirname))
+		isMigration, err := isMigrationDir(source, path.Join(dir, name))
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
-		parts := strings.Split(dirname, "_")
-		if len(parts) < 4 {
-			return nil, fmt.Errorf("Malformed migration name: %q", dirname)
+		if !isMigration {
+			setDirs = append(setDirs, path.Join(dir, name))
+			continue
 		}
 
-		num, err := strconv.Atoi(parts[0])
+		m, err := migrationFromDir(source, dir, name)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to decode migration number: %v", err)
+			return nil, nil, err
+		}
+
+		m.Set = set
+		migrations = append(migrations, m)
+	}
+
+	sortMigrations(migrations)
+
+	return migrations, setDirs, nil
+}
+
+// Reads the repeatable migrations, i.e. the .sql files, of a repeatable
+// directory.
+func repeatableMigrationsFromDir(source fs.FS, dir string) (MigrationSlice, error) {
+	files, err := fs.ReadDir(source, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations MigrationSlice
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".") || file.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
 		}
 
-		migrations[i] = &Migration{
-			Name: dirname,
-			Num:  num,
-			Up:   string(up),
-			Down: string(down),
+		up, err := readFile(source, path.Join(dir, name))
+		if err != nil {
+			return nil, err
 		}
+
+		migrations = append(migrations, &Migration{
+			Name:       strings.TrimSuffix(name, ".sql"),
+			Up:         string(up),
+			Repeatable: true,
+		})
 	}
 
 	return migrations, nil
 }
 
-// Return next migration number.
+// Sorts the migrations by number, followed by the repeatable migrations by
+// name.
+func sortMigrations(slice MigrationSlice) {
+	sort.SliceStable(slice, func(i, j int) bool {
+		a, b := slice[i], slice[j]
+		if a.Repeatable != b.Repeatable {
+			return b.Repeatable
+		}
+
+		if a.Repeatable {
+			return a.Name < b.Name
+		}
+
+		return a.Num < b.Num
+	})
+}
+
+// Reads a migration from the up.sql and down.sql files of a migration
+// directory.
+func migrationFromDir(source fs.FS, dir, dirname string) (*Migration, error) {
+	up, err := readFile(source, path.Join(dir, dirname, "up.sql"))
+	if err != nil {
+		return nil, err
+	}
+
+	down, err := readFile(source, path.Join(dir, dirname, "down.sql"))
+	if err != nil {
+		return nil, err
+	}
+
+	num, err := decodeMigrationNum(dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	irreversible, err := fileExists(source, path.Join(dir, dirname, irreversibleFile))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migration{
+		Name:          dirname,
+		Num:           num,
+		Up:            string(up),
+		Down:          string(down),
+		NoTransaction: hasNoTransactionDirective(string(up)) || hasNoTransactionDirective(string(down)),
+		Baseline:      hasBaselineDirective(string(up)),
+		Irreversible:  irreversible || hasIrreversibleDirective(string(down)),
+	}, nil
+}
+
+// Reads a migration from a single file with `-- +up` and `-- +down`
+// sections. The migration is named after the file, without the .sql suffix.
+func migrationFromFile(source fs.FS, dir, fname string) (*Migration, error) {
+	contents, err := readFile(source, path.Join(dir, fname))
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSuffix(fname, ".sql")
+	num, err := decodeMigrationNum(name)
+	if err != nil {
+		return nil, err
+	}
+
+	preamble, up, down, err := splitSections(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("Malformed migration %q: %v", fname, err)
+	}
+
+	return &Migration{
+		Name: name,
+		Num:  num,
+		Up:   up,
+		Down: down,
+		NoTransaction: hasNoTransactionDirective(preamble) ||
+			hasNoTransactionDirective(up) ||
+			hasNoTransactionDirective(down),
+		Baseline:     hasBaselineDirective(preamble) || hasBaselineDirective(up),
+		Irreversible: hasIrreversibleDirective(preamble) || hasIrreversibleDirective(down),
+	}, nil
+}
+
+func decodeMigrationNum(name string) (int, error) {
+	parts := strings.Split(name, "_")
+	if len(parts) < 4 {
+		return 0, fmt.Errorf("Malformed migration name: %q", name)
+	}
+
+	num, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("Failed to decode migration number: %v", err)
+	}
+
+	return num, nil
+}
+
+// Directories starting with a digit, or holding up.sql or down.sql, are
+// migrations. Other directories hold migration sets.
+func isMigrationDir(source fs.FS, dir string) (bool, error) {
+	name := path.Base(dir)
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		return true, nil
+	}
+
+	entries, err := fs.ReadDir(source, dir)
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range entries {
+		if migrationFiles[entry.Name()] {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// SQL files starting with a digit are single file migrations.
+func isMigrationFile(name string) bool {
+	return strings.HasSuffix(name, ".sql") && name[0] >= '0' && name[0] <= '9'
+}
+
+// Returns the name of the migration set the slice belongs to.
+func (slice MigrationSlice) set() string {
+	if len(slice) == 0 {
+		return ""
+	}
+
+	return slice[0].Set
+}
+
+// Returns the migrations without the repeatable migrations.
+func (slice MigrationSlice) numbered() MigrationSlice {
+	var numbered MigrationSlice
+	for _, m := range slice {
+		if !m.Repeatable {
+			numbered = append(numbered, m)
+		}
+	}
+
+	return numbered
+}
+
+// Returns the latest baseline migration, or nil.
+func (slice MigrationSlice) baseline() *Migration {
+	var baseline *Migration
+	for _, m := range slice {
+		if m.Baseline && (baseline == nil || m.Num > baseline.Num) {
+			baseline = m
+		}
+	}
+
+	return baseline
+}
+
+// Return next migration number with VersioningSequential. Timestamp numbers
+// are ignored, and a baseline counts for the migrations it squashed.
 func (slice MigrationSlice) NextNum() int {
-	return len(slice) + 1
+	max := 0
+	for _, m := range slice.numbered() {
+		if m.Num > max && !isTimestampNum(m.Num) {
+			max = m.Num
+		}
+	}
+
+	return max + 1
 }
 
-// Create a new migration. baseDir should point to the directory where all the
-// migrations live.
-func (slice MigrationSlice) CreateNext(baseDir, migrationName string) (*Migration, error) {
+// Returns the name for the next migration, and the scripts for it rendered
+// from the template in opts, if any.
+func (slice MigrationSlice) next(migrationName string, opts *options) (name, up, down string, err error) {
+	now := time.Now()
 	num := slice.NextNum()
+	if opts.versioning == VersioningTimestamp {
+		// UTC, so that the order doesn't depend on the author's time zone.
+		now = now.UTC()
+		num, err = strconv.Atoi(now.Format(timestampFormat))
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+
+	name = fmt.Sprintf("%04d_%s_%s", num, now.Format(format), migrationName)
+
+	if opts.template == nil {
+		return name, "", "", nil
+	}
+
+	data := &TemplateData{
+		Name:        name,
+		Num:         num,
+		Description: migrationName,
+		Author:      opts.author,
+		Ticket:      opts.ticket,
+		Date:        now,
+	}
+
+	if table, ok := strings.CutPrefix(migrationName, "create_"); ok {
+		data.Table = table
+	}
+
+	up, down, err = opts.template.render(data)
+	return name, up, down, err
+}
 
-	d := time.Now().Format(format)
-	name := fmt.Sprintf("%04d_%s_%s", num, d, migrationName)
+// Create a new migration. baseDir should point to the directory where all the
+// migrations live. The scripts are empty, unless a template is given with
+// OptionTemplate. The migration is numbered according to OptionVersioning.
+func (slice MigrationSlice) CreateNext(baseDir, migrationName string, opts ...Option) (*Migration, error) {
+	name, up, down, err := slice.next(migrationName, newOptions(opts...))
+	if err != nil {
+		return nil, err
+	}
 
 	dir := baseDir + "/" + name
 	if err := os.Mkdir(dir, 0755); err != nil {
 		return nil, err
 	}
 
-	for _, fname := range []string{"/up.sql", "/down.sql"} {
-		f, err := os.Create(dir + fname)
-		if err != nil {
+	files := map[string]string{
+		"/up.sql":   up,
+		"/down.sql": down,
+	}
+
+	for fname, contents := range files {
+		if err := os.WriteFile(dir+fname, []byte(contents), 0644); err != nil {
 			return nil, err
 		}
+	}
+
+	return &Migration{
+		Name: name,
+	}, nil
+}
+
+// Create a new single file migration with `-- +up` and `-- +down` sections.
+// baseDir should point to the directory where all the migrations live. The
+// sections are empty, unless a template is given with OptionTemplate.
+func (slice MigrationSlice) CreateNextFile(baseDir, migrationName string, opts ...Option) (*Migration, error) {
+	name, up, down, err := slice.next(migrationName, newOptions(opts...))
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(baseDir+"/"+name+".sql", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%s\n%s\n%s\n%s", upMarker, up, downMarker, down); err != nil {
+		return nil, err
+	}
 
-		f.Close()
+	if err := f.Close(); err != nil {
+		return nil, err
 	}
 
 	return &Migration{
@@ -108,7 +440,7 @@ func (slice MigrationSlice) CreateNext(baseDir, migrationName string) (*Migratio
 
 func (slice MigrationSlice) Find(num int) *Migration {
 	for _, m := range slice {
-		if m.Num == num {
+		if m.Num == num && !m.Repeatable {
 			return m
 		}
 	}
@@ -116,62 +448,429 @@ func (slice MigrationSlice) Find(num int) *Migration {
 	return nil
 }
 
-func (slice MigrationSlice) RevertCurrent(ctx context.Context, tx pgx.Tx) error {
-	num, err := QuerySchemaVersion(ctx, tx)
+// Reverts the latest applied migration. See RevertSteps.
+func (slice MigrationSlice) RevertCurrent(ctx context.Context, tx pgx.Tx, opts ...Option) error {
+	return slice.RevertSteps(ctx, tx, 1, opts...)
+}
+
+// Reverts the latest steps applied migrations in tx, newest first. Negative
+// steps means all the applied migrations. Hooks given with OptionHooks are all
+// called in tx, BeforeRun and AfterRun once for the whole run.
+//
+// Returns ErrSchemaOutdated if the tables tracking migrations need an upgrade,
+// see CheckSchema.
+func (slice MigrationSlice) RevertSteps(ctx context.Context, tx pgx.Tx, steps int, opts ...Option) error {
+	o := newOptions(opts...)
+	if err := acquireLock(ctx, tx, o); err != nil {
+		return err
+	}
+
+	if err := CheckSchema(ctx, tx); err != nil {
+		return err
+	}
+
+	if err := setStatementTimeout(ctx, tx, o.statementTimeout, true); err != nil {
+		return err
+	}
+
+	plan, err := slice.revertPlan(ctx, tx, steps, 0)
 	if err != nil {
 		return err
 	}
 
-	m := slice.Find(num)
-	if m == nil {
-		return fmt.Errorf("Migration %d not found (corrupted state)", num)
+	for _, m := range plan {
+		if m.NoTransaction {
+			return fmt.Errorf("Migration '%s' must be reverted outside a transaction, use MigrateTo instead", m.Name)
+		}
 	}
 
-	if _, err := tx.Exec(ctx, m.Down); err != nil {
+	run := &RunInfo{Set: slice.set(), Migrations: plan, Down: true, Start: time.Now()}
+	if err := o.hooks.beforeRun(ctx, tx, run); err != nil {
 		return err
 	}
 
-	return setSchemaVersion(ctx, tx, m.Num-1)
+	for _, m := range plan {
+		s := step{m: m, down: true}
+		err := s.track(o, func() error {
+			return runStep(ctx, tx, s, o)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	run.Duration = time.Since(run.Start)
+	return o.hooks.afterRun(ctx, tx, run)
+}
+
+// Returns an error if the migration cannot be reverted.
+func (m *Migration) checkReversible() error {
+	if m.Baseline {
+		return fmt.Errorf("Migration '%s' is a baseline and cannot be reverted", m.Name)
+	}
+
+	if m.Irreversible {
+		return fmt.Errorf("Migration '%s' is marked irreversible and cannot be reverted, write a new migration to undo its changes instead", m.Name)
+	}
+
+	return nil
 }
 
 type applyDB interface {
 	Begin(context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
 }
 
-// Applies all pending migrations to the database.
-func (slice MigrationSlice) ApplyAll(db applyDB, logger Logger) error {
-	ctx := context.TODO()
+// Implemented by connection pools (e.g. *pgxpool.Pool), which need to be
+// pinned to a single connection for the duration of a run.
+type acquirer interface {
+	Acquire(context.Context) (*pgxpool.Conn, error)
+}
+
+// Applies all pending migrations to the database. See ApplyAllContext.
+func (slice MigrationSlice) ApplyAll(db applyDB, logger Logger, opts ...Option) error {
+	return slice.ApplyAllContext(context.Background(), db, logger, opts...)
+}
+
+// Applies all pending migrations to the database. If ctx is cancelled, the
+// migrations of the ongoing transaction are rolled back.
+//
+// The migrations are checked with Validate before anything is applied.
+//
+// An advisory lock is held for the duration of the run, so concurrent runs
+// wait for each other instead of racing.
+//
+// Repeatable migrations that have changed since they were last applied are
+// re-run after the numbered migrations.
+//
+// Hooks given with OptionHooks are called around the run and each migration.
+//
+// By default migrations are run in a single transaction, except for
+// migrations marked with NoTransaction. Those are run on their own, and the
+// migrations before them are committed first. With TransactionPerMigration
+// each migration is committed as soon as it is applied.
+func (slice MigrationSlice) ApplyAllContext(ctx context.Context, db applyDB, logger Logger, opts ...Option) error {
+	o := newOptions(opts...)
+	o.logger = logger
+
+	if err := slice.Validate(); err != nil {
+		return err
+	}
+
+	return withLockedConn(ctx, db, o, func(conn applyDB) error {
+		var steps []step
+		var run *RunInfo
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			err := EnsureSchema(ctx, tx)
+			if err != nil {
+				return err
+			}
 
-	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
-		err := EnsureSchema(ctx, tx)
+			if err := slice.Verify(ctx, tx); err != nil {
+				return err
+			}
+
+			plan, err := slice.applyAllPlan(ctx, tx, o)
+			if err != nil {
+				return err
+			}
+
+			for _, m := range plan {
+				steps = append(steps, step{m: m})
+			}
+
+			run = &RunInfo{Set: slice.set(), Migrations: plan, Start: time.Now()}
+			return o.hooks.beforeRun(ctx, tx, run)
+		})
 		if err != nil {
 			return err
 		}
 
-		current, err := QuerySchemaVersion(ctx, tx)
+		return runPlanned(ctx, conn, run, steps, o)
+	})
+}
+
+// Applies or reverts migrations until the database is at the target version,
+// i.e. all the migrations up to and including target are applied and none
+// after it. Transactions are used the same way as in ApplyAll.
+func (slice MigrationSlice) MigrateTo(ctx context.Context, db applyDB, target int, logger Logger, opts ...Option) error {
+	o := newOptions(opts...)
+	o.logger = logger
+
+	if target < 0 {
+		return fmt.Errorf("Invalid target version: %d", target)
+	}
+
+	if err := slice.Validate(); err != nil {
+		return err
+	}
+
+	if target > 0 && slice.Find(target) == nil {
+		return fmt.Errorf("Migration %d not found", target)
+	}
+
+	return withLockedConn(ctx, db, o, func(conn applyDB) error {
+		var steps []step
+		var run *RunInfo
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			err := EnsureSchema(ctx, tx)
+			if err != nil {
+				return err
+			}
+
+			if err := slice.Verify(ctx, tx); err != nil {
+				return err
+			}
+
+			up, err := slice.applyPlan(ctx, tx, target, o)
+			if err != nil {
+				return err
+			}
+
+			down, err := slice.revertPlan(ctx, tx, -1, target)
+			if err != nil {
+				return err
+			}
+
+			for _, m := range down {
+				steps = append(steps, step{m: m, down: true})
+			}
+
+			for _, m := range up {
+				steps = append(steps, step{m: m})
+			}
+
+			run = &RunInfo{Set: slice.set(), Migrations: append(down, up...), Start: time.Now()}
+			return o.hooks.beforeRun(ctx, tx, run)
+		})
 		if err != nil {
 			return err
 		}
 
-		for m := slice.Find(current + 1); m != nil; m = slice.Find(current + 1) {
-			logger.Printf("Applying '%s'...", m.Name)
+		return runPlanned(ctx, conn, run, steps, o)
+	})
+}
+
+// PartialMigrationError is returned when a migration that is run outside a
+// transaction fails. The statements before the failed one are not rolled back
+// and need to be dealt with manually before retrying.
+type PartialMigrationError struct {
+	Name string
+	Down bool
+	// Number of statements that were executed successfully.
+	Executed int
+	Total    int
+	Err      error
+}
+
+func (e *PartialMigrationError) Error() string {
+	action := "Applying"
+	if e.Down {
+		action = "Reverting"
+	}
+
+	if e.Executed == e.Total {
+		return fmt.Sprintf(
+			"%s '%s' outside a transaction succeeded, but recording the schema version failed: %v",
+			action, e.Name, e.Err,
+		)
+	}
+
+	return fmt.Sprintf(
+		"%s '%s' outside a transaction failed at statement %d of %d (%d already executed and NOT rolled back): %v",
+		action, e.Name, e.Executed+1, e.Total, e.Executed, e.Err,
+	)
+}
 
-			_, err := tx.Exec(ctx, m.Up)
+func (e *PartialMigrationError) Unwrap() error {
+	return e.Err
+}
+
+type step struct {
+	m    *Migration
+	down bool
+}
+
+// Runs the steps of the run, and the AfterRun hooks in a transaction of their
+// own.
+func runPlanned(ctx context.Context, conn applyDB, run *RunInfo, steps []step, o *options) error {
+	if err := runSteps(ctx, conn, steps, o); err != nil {
+		return err
+	}
+
+	if len(o.hooks) == 0 {
+		return nil
+	}
+
+	run.Duration = time.Since(run.Start)
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		return o.hooks.afterRun(ctx, tx, run)
+	})
+}
+
+// Runs the steps in order. With TransactionSingle, consecutive transactional
+// steps share a transaction.
+func runSteps(ctx context.Context, conn applyDB, steps []step, o *options) error {
+	for len(steps) > 0 {
+		if s := steps[0]; s.m.NoTransaction {
+			err := s.track(o, func() error {
+				return runNoTransaction(ctx, conn, s, o)
+			})
 			if err != nil {
 				return err
 			}
 
-			if err := setSchemaVersion(ctx, tx, m.Num); err != nil {
-				return err
+			steps = steps[1:]
+			continue
+		}
+
+		n := 1
+		for o.transactionMode == TransactionSingle && n < len(steps) && !steps[n].m.NoTransaction {
+			n++
+		}
+
+		batch := steps[:n]
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			for _, s := range batch {
+				err := s.track(o, func() error {
+					return runStep(ctx, tx, s, o)
+				})
+				if err != nil {
+					return err
+				}
 			}
 
-			current = m.Num
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 
-		return nil
+		steps = steps[n:]
+	}
+
+	return nil
+}
+
+// Applies or reverts the step's migration in tx, surrounded by the migration
+// hooks.
+func runStep(ctx context.Context, tx pgx.Tx, s step, o *options) error {
+	info := MigrationInfo{Down: s.down, Start: time.Now()}
+	if err := o.hooks.beforeMigration(ctx, tx, s.m, info); err != nil {
+		return err
+	}
+
+	var err error
+	if s.down {
+		err = revertMigration(ctx, tx, s.m)
+	} else {
+		err = applyMigration(ctx, tx, s.m)
+	}
+	if err != nil {
+		return err
+	}
+
+	info.Duration = time.Since(info.Start)
+	return o.hooks.afterMigration(ctx, tx, s.m, info)
+}
+
+// Runs the step's statements one by one outside a transaction, and records
+// the schema version afterwards in a transaction of its own.
+func runNoTransaction(ctx context.Context, conn applyDB, s step, o *options) error {
+	script := s.m.Up
+	if s.down {
+		script = s.m.Down
+	}
+
+	info := MigrationInfo{Down: s.down, Start: time.Now()}
+	if len(o.hooks) > 0 {
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			return o.hooks.beforeMigration(ctx, tx, s.m, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	stmts := splitStatements(script)
+	start := time.Now()
+
+	for i, stmt := range stmts {
+		if _, err := conn.Exec(ctx, stmt); err != nil {
+			return &PartialMigrationError{Name: s.m.Name, Down: s.down, Executed: i, Total: len(stmts), Err: err}
+		}
+	}
+
+	d := time.Since(start)
+	err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		var err error
+		if s.down {
+			err = forgetMigration(ctx, tx, s.m)
+		} else {
+			err = recordMigration(ctx, tx, s.m, d)
+		}
+		if err != nil {
+			return err
+		}
+
+		info.Duration = time.Since(info.Start)
+		return o.hooks.afterMigration(ctx, tx, s.m, info)
 	})
+	if err != nil {
+		return &PartialMigrationError{Name: s.m.Name, Down: s.down, Executed: len(stmts), Total: len(stmts), Err: err}
+	}
+
+	return nil
+}
+
+func applyMigration(ctx context.Context, tx pgx.Tx, m *Migration) error {
+	start := time.Now()
+	if m.UpFunc != nil {
+		if err := m.UpFunc(ctx, tx); err != nil {
+			return err
+		}
+	} else if _, err := tx.Exec(ctx, m.Up); err != nil {
+		return err
+	}
+
+	if m.Repeatable {
+		return recordRepeatable(ctx, tx, m, time.Since(start))
+	}
+
+	return recordMigration(ctx, tx, m, time.Since(start))
+}
+
+func revertMigration(ctx context.Context, tx pgx.Tx, m *Migration) error {
+	if m.DownFunc != nil {
+		if err := m.DownFunc(ctx, tx); err != nil {
+			return err
+		}
+	} else if _, err := tx.Exec(ctx, m.Down); err != nil {
+		return err
+	}
+
+	return forgetMigration(ctx, tx, m)
+}
+
+// Returns the path of the migration directory or single file migration in
+// baseDir.
+func migrationPath(baseDir, name string) string {
+	p := baseDir + "/" + name
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		return p + ".sql"
+	}
+
+	return p
+}
+
+func fileExists(source fs.FS, fname string) (bool, error) {
+	_, err := fs.Stat(source, fname)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
 
-	return err
+	return err == nil, err
 }
 
 func readFile(fs fs.FS, fname string) ([]byte, error) {
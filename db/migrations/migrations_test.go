@@ -2,18 +2,31 @@ package migrations_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/jackc/pgx/v5/stdlib"
 
 	"github.com/vhakulinen/dino/db/dbtest"
+	"github.com/vhakulinen/dino/db/fixtures"
 	"github.com/vhakulinen/dino/db/migrations"
 	"github.com/vhakulinen/dino/db/utils"
 )
@@ -115,6 +128,9 @@ func TestMigrationSlice_ApplyAll(t *testing.T) {
 		return tables
 	}
 
+	// The tables are listed in no particular order.
+	sortStrings := cmpopts.SortSlices(func(a, b string) bool { return a < b })
+
 	tests := map[string]Test{
 		"empty database": {
 			Run: func(t *testing.T, db *pgxpool.Pool, migs migrations.MigrationSlice) {
@@ -124,13 +140,14 @@ func TestMigrationSlice_ApplyAll(t *testing.T) {
 
 				got := tables(t, db)
 				expected := []string{
-					"schema_version",
+					"schema_migrations",
+					"schema_repeatable_migrations",
 					"one",
 					"second",
 					"third",
 				}
 
-				if diff := cmp.Diff(got, expected); diff != "" {
+				if diff := cmp.Diff(got, expected, sortStrings); diff != "" {
 					t.Fatal(diff)
 				}
 			},
@@ -151,13 +168,14 @@ func TestMigrationSlice_ApplyAll(t *testing.T) {
 
 				got := tables(t, db)
 				expected := []string{
-					"schema_version",
+					"schema_migrations",
+					"schema_repeatable_migrations",
 					"one",
 					"second",
 					"third",
 				}
 
-				if diff := cmp.Diff(got, expected); diff != "" {
+				if diff := cmp.Diff(got, expected, sortStrings); diff != "" {
 					t.Fatal(diff)
 				}
 			},
@@ -172,10 +190,11 @@ func TestMigrationSlice_ApplyAll(t *testing.T) {
 
 				partialGot := tables(t, db)
 				partialExpected := []string{
-					"schema_version",
+					"schema_migrations",
+					"schema_repeatable_migrations",
 					"one",
 				}
-				if diff := cmp.Diff(partialGot, partialExpected); diff != "" {
+				if diff := cmp.Diff(partialGot, partialExpected, sortStrings); diff != "" {
 					t.Fatal(diff)
 				}
 
@@ -185,13 +204,65 @@ func TestMigrationSlice_ApplyAll(t *testing.T) {
 
 				got := tables(t, db)
 				expected := []string{
-					"schema_version",
+					"schema_migrations",
+					"schema_repeatable_migrations",
+					"one",
+					"second",
+					"third",
+				}
+
+				if diff := cmp.Diff(got, expected, sortStrings); diff != "" {
+					t.Fatal(diff)
+				}
+			},
+		},
+		"legacy schema_version": {
+			Run: func(t *testing.T, db *pgxpool.Pool, migs migrations.MigrationSlice) {
+				ctx := context.TODO()
+				_, err := db.Exec(ctx, `
+					CREATE TABLE schema_version (version INTEGER NOT NULL DEFAULT 0);
+					INSERT INTO schema_version VALUES (1);
+					CREATE TABLE one (id SERIAL PRIMARY KEY);
+				`)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := migs.ApplyAll(db, log.Default()); err != nil {
+					t.Fatal(err)
+				}
+
+				got := tables(t, db)
+				expected := []string{
 					"one",
+					"schema_migrations",
+					"schema_repeatable_migrations",
 					"second",
 					"third",
 				}
 
-				if diff := cmp.Diff(got, expected); diff != "" {
+				if diff := cmp.Diff(got, expected, sortStrings); diff != "" {
+					t.Fatal(diff)
+				}
+
+				var names []string
+				err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+					history, err := migrations.QueryHistory(ctx, tx)
+					for _, r := range history {
+						names = append(names, r.Name)
+					}
+					return err
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				expectedNames := []string{
+					"",
+					"0002_20210726_2134_second",
+					"0003_20210726_2134_third",
+				}
+				if diff := cmp.Diff(names, expectedNames); diff != "" {
 					t.Fatal(diff)
 				}
 			},
@@ -217,3 +288,1707 @@ func TestMigrationSlice_ApplyAll(t *testing.T) {
 		})
 	}
 }
+
+func TestMigrationSlice_Verify(t *testing.T) {
+	db := openTestDB(t)
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migs.ApplyAll(db, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	migs[1].Up += "CREATE TABLE extra ();\n"
+	migs[2].Down += "DROP TABLE extra;\n"
+
+	err = migs.ApplyAll(db, log.Default())
+
+	var drift *migrations.DriftError
+	if !errors.As(err, &drift) {
+		t.Fatalf("Expected DriftError, got %v", err)
+	}
+
+	expected := []migrations.Drift{
+		{Num: 2, Name: "0002_20210726_2134_second", Up: true},
+		{Num: 3, Name: "0003_20210726_2134_third", Down: true},
+	}
+	if diff := cmp.Diff(drift.Drifted, expected); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestDriftError_Error(t *testing.T) {
+	err := &migrations.DriftError{Drifted: []migrations.Drift{
+		{Num: 2, Name: "0002_20210726_2134_second", Up: true},
+		{Num: 3, Name: "0003_20210726_2134_third", Up: true, Down: true},
+	}}
+
+	expected := `2 applied migration(s) have drifted from what the database recorded:
+  0002_20210726_2134_second: up.sql
+  0003_20210726_2134_third: up.sql, down.sql`
+
+	if diff := cmp.Diff(err.Error(), expected); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMigrationSlice_Status(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migs[:2].ApplyAll(db, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	var status *migrations.Status
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		status, err = migrations.MigrationSlice{migs[0], migs[2]}.Status(ctx, tx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &migrations.Status{
+		Version: 2,
+		Migrations: []migrations.MigrationStatus{
+			{Num: 1, Name: "0001_20210726_2134_first", Applied: true},
+			{Num: 2, Name: "0002_20210726_2134_second", Applied: true, Unknown: true},
+			{Num: 3, Name: "0003_20210726_2134_third"},
+		},
+	}
+
+	opt := cmpopts.IgnoreFields(migrations.MigrationStatus{}, "AppliedAt")
+	if diff := cmp.Diff(status, expected, opt); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMigrationSlice_Status_readOnly(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func() *migrations.Status {
+		t.Helper()
+
+		var status *migrations.Status
+		err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+			status, err = migs.Status(ctx, tx)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return status
+	}
+
+	expected := &migrations.Status{
+		Migrations: []migrations.MigrationStatus{
+			{Num: 1, Name: "0001_20210726_2134_first"},
+			{Num: 2, Name: "0002_20210726_2134_second"},
+			{Num: 3, Name: "0003_20210726_2134_third"},
+		},
+	}
+
+	if diff := cmp.Diff(status(), expected); diff != "" {
+		t.Fatalf("fresh database: %s", diff)
+	}
+
+	_, err = db.Exec(ctx, `
+		CREATE TABLE schema_version (version INTEGER NOT NULL DEFAULT 0);
+		INSERT INTO schema_version VALUES (2);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = &migrations.Status{
+		Version: 2,
+		Migrations: []migrations.MigrationStatus{
+			{Num: 1, Name: "0001_20210726_2134_first", Applied: true},
+			{Num: 2, Name: "0002_20210726_2134_second", Applied: true},
+			{Num: 3, Name: "0003_20210726_2134_third"},
+		},
+	}
+
+	if diff := cmp.Diff(status(), expected); diff != "" {
+		t.Fatalf("legacy database: %s", diff)
+	}
+
+	// The legacy table is left for apply to upgrade.
+	got, err := utils.QueryAllTableNames(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(got, []string{"schema_version"}); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMigrationSlice_ApplyPlan_readOnly(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan := func() (migrations.MigrationSlice, error) {
+		var plan migrations.MigrationSlice
+		err := pgx.BeginTxFunc(ctx, db, pgx.TxOptions{AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+			var err error
+			plan, err = migs.ApplyPlan(ctx, tx)
+			return err
+		})
+
+		return plan, err
+	}
+
+	// A fresh database is planned without creating the tables.
+	got, err := plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 migrations in the plan, got %d", len(got))
+	}
+
+	if err := migs[:1].ApplyAll(db, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	migs[0].Up = "SELECT 1;"
+
+	var drift *migrations.DriftError
+	if _, err := plan(); !errors.As(err, &drift) {
+		t.Fatalf("Expected DriftError, got %v", err)
+	}
+}
+
+func TestMigrationSlice_MigrateTo(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		target int
+		tables []string
+	}{
+		{2, []string{"schema_migrations", "schema_repeatable_migrations", "one", "second"}},
+		{3, []string{"schema_migrations", "schema_repeatable_migrations", "one", "second", "third"}},
+		{1, []string{"schema_migrations", "schema_repeatable_migrations", "one"}},
+		{0, []string{"schema_migrations", "schema_repeatable_migrations"}},
+	}
+
+	for _, step := range steps {
+		if err := migs.MigrateTo(ctx, db, step.target, log.Default()); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := utils.QueryAllTableNames(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opt := cmpopts.SortSlices(func(a, b string) bool { return a < b })
+		if diff := cmp.Diff(got, step.tables, opt); diff != "" {
+			t.Fatalf("target %d: %s", step.target, diff)
+		}
+	}
+
+	if err := migs.MigrateTo(ctx, db, 4, log.Default()); err == nil {
+		t.Fatal("Expected error for unknown target")
+	}
+}
+
+func TestMigrationSlice_RevertPlan(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migs.ApplyAll(db, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[int]migrations.MigrationSlice{
+		0:  nil,
+		2:  {migs[2], migs[1]},
+		5:  {migs[2], migs[1], migs[0]},
+		-1: {migs[2], migs[1], migs[0]},
+	}
+
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		for steps, expected := range tests {
+			got, err := migs.RevertPlan(ctx, tx, steps)
+			if err != nil {
+				return err
+			}
+
+			if diff := cmp.Diff(got, expected); diff != "" {
+				t.Errorf("steps %d: %s", steps, diff)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationSlice_WriteDownSQL(t *testing.T) {
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := (migrations.MigrationSlice{migs[1], migs[0]}).WriteDownSQL(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `-- Revert 0002_20210726_2134_second
+DROP TABLE second;
+
+-- Revert 0001_20210726_2134_first
+DROP TABLE one;
+
+`
+	if diff := cmp.Diff(b.String(), expected); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMigrationSlice_WriteUpSQL(t *testing.T) {
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := migs[:2].WriteUpSQL(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `-- Apply 0001_20210726_2134_first
+CREATE TABLE one (
+    id SERIAL PRIMARY KEY
+);
+
+-- Apply 0002_20210726_2134_second
+CREATE TABLE second (
+    id SERIAL PRIMARY KEY
+);
+
+`
+	if diff := cmp.Diff(b.String(), expected); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMigrationSlice_ApplyAll_locked(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := migrations.Lock(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+
+	err = migs.ApplyAll(db, log.Default(), migrations.OptionLockTimeout(time.Second))
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Fatalf("Expected lock timeout, got %v", err)
+	}
+
+	if err := tx.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migs.ApplyAll(db, log.Default(), migrations.OptionLockTimeout(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationSlice_ApplyAll_noTransaction(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS("testdata/notxmigrations"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if migs[0].NoTransaction || !migs[1].NoTransaction {
+		t.Fatal("Expected only the second migration to be non-transactional")
+	}
+
+	indexes := func() []string {
+		rows, err := db.Query(ctx, `SELECT indexname FROM pg_indexes WHERE tablename = 'items' ORDER BY indexname`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return names
+	}
+
+	if err := migs.ApplyAll(db, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(indexes(), []string{"items_name_idx", "items_pkey"}); diff != "" {
+		t.Fatal(diff)
+	}
+
+	if err := migs.MigrateTo(ctx, db, 1, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(indexes(), []string{"items_pkey"}); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMigrationSlice_ApplyAll_transactionMode(t *testing.T) {
+	tests := map[string]struct {
+		mode     migrations.TransactionMode
+		expected int
+	}{
+		"single":        {migrations.TransactionSingle, 0},
+		"per migration": {migrations.TransactionPerMigration, 2},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db := openTestDB(t)
+
+			migs[2].Up = "NOT VALID SQL"
+
+			err = migs.ApplyAll(db, log.Default(), migrations.OptionTransactionMode(tt.mode))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+
+			var version int
+			err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+				version, err = migrations.QuerySchemaVersion(ctx, tx)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if version != tt.expected {
+				t.Fatalf("Expected version %d, got %d", tt.expected, version)
+			}
+		})
+	}
+}
+
+func TestMigrationSlice_ApplyAllContext(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migs[1].Up = "SELECT pg_sleep(10);\n" + migs[1].Up
+
+	t.Run("statement timeout", func(t *testing.T) {
+		err := migs.ApplyAllContext(ctx, db, log.Default(), migrations.OptionStatementTimeout(100*time.Millisecond))
+		if err == nil || !strings.Contains(err.Error(), "statement timeout") {
+			t.Fatalf("Expected statement timeout, got %v", err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+
+		err := migs.ApplyAllContext(ctx, db, log.Default())
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected context deadline, got %v", err)
+		}
+	})
+
+	got, err := utils.QueryAllTableNames(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt := cmpopts.SortSlices(func(a, b string) bool { return a < b })
+	if diff := cmp.Diff(got, []string{"schema_migrations", "schema_repeatable_migrations"}, opt); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestLintFS(t *testing.T) {
+	file := &fstest.MapFile{Data: []byte("SELECT 1;\n")}
+
+	source := fstest.MapFS{
+		".gitkeep":                          file,
+		"notes.txt":                         file,
+		"0001_20210726_2134_first/up.sql":   file,
+		"0001_20210726_2134_first/down.sql": file,
+		"0002_20210726_2134_a/up.sql":       file,
+		"0002_20210726_2134_a/down.sql":     file,
+		"0002_20210726_2135_b/up.sql":       file,
+		"0002_20210726_2135_b/down.sql":     file,
+		"0005_20210726_2134_late/up.sql":    file,
+		"0005_20210726_2134_late/notes.md":  file,
+		"0006_foo/up.sql":                   file,
+		"0006_foo/down.sql":                 file,
+		"repeatable/views.sql":              file,
+		"repeatable/notes.txt":              file,
+	}
+
+	err := migrations.LintFS(source)
+
+	var verr *migrations.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected ValidationError, got %v", err)
+	}
+
+	expected := []migrations.Problem{
+		{Kind: migrations.ProblemJunk, Path: "0005_20210726_2134_late/notes.md", Message: "unexpected file in migration directory"},
+		{Kind: migrations.ProblemMissingFile, Path: "0005_20210726_2134_late/down.sql", Message: "file is missing"},
+		{Kind: migrations.ProblemName, Path: "0006_foo", Message: "name does not match the NNNN_YYYYMMDD_HHMM_name format"},
+		{Kind: migrations.ProblemJunk, Path: "notes.txt", Message: "not a migration directory or file"},
+		{Kind: migrations.ProblemJunk, Path: "repeatable/notes.txt", Message: "not a repeatable migration"},
+		{Kind: migrations.ProblemDuplicate, Path: "0002_20210726_2134_a", Message: "migration number 2 is used by 2 migrations"},
+		{Kind: migrations.ProblemDuplicate, Path: "0002_20210726_2135_b", Message: "migration number 2 is used by 2 migrations"},
+		{Kind: migrations.ProblemGap, Path: "0005_20210726_2134_late", Message: "migration(s) 3-4 missing before this migration"},
+	}
+
+	if diff := cmp.Diff(verr.Problems, expected); diff != "" {
+		t.Fatal(diff)
+	}
+
+	if err := migrations.LintFS(os.DirFS(testmigrationsPath)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	t.Cleanup(migrations.ResetRegistry)
+
+	noop := func(ctx context.Context, tx pgx.Tx) error { return nil }
+
+	migrations.Register("0004_20240101_1200_go_migration", func(ctx context.Context, tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `CREATE TABLE four (id SERIAL PRIMARY KEY)`)
+		return err
+	}, func(ctx context.Context, tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `DROP TABLE four`)
+		return err
+	})
+
+	t.Run("malformed name", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Expected a panic")
+			}
+		}()
+
+		migrations.Register("go_migration", noop, noop)
+	})
+
+	fsMigs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migs := fsMigs.Merge(migrations.Registered())
+	if got := migs.NextNum(); got != 5 {
+		t.Fatalf("Expected next num 5, got %d", got)
+	}
+
+	if err := migrations.LintFS(os.DirFS(testmigrationsPath), migrations.Registered()...); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	if err := migs.ApplyAll(db, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := cmpopts.SortSlices(func(a, b string) bool { return a < b })
+
+	got, err := utils.QueryAllTableNames(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(got, []string{"schema_migrations", "schema_repeatable_migrations", "one", "second", "third", "four"}, opt); diff != "" {
+		t.Fatal(diff)
+	}
+
+	if err := migs.MigrateTo(ctx, db, 3, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = utils.QueryAllTableNames(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(got, []string{"schema_migrations", "schema_repeatable_migrations", "one", "second", "third"}, opt); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMigrationSetsFromFS(t *testing.T) {
+	source := os.DirFS("testdata/setmigrations")
+
+	sets, err := migrations.MigrationSetsFromFS(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(sets migrations.MigrationSets) map[string][]string {
+		got := make(map[string][]string)
+		for _, set := range sets {
+			for _, m := range set.Migrations {
+				if m.Set != set.Name {
+					t.Errorf("Migration %s has set %q, expected %q", m.Name, m.Set, set.Name)
+				}
+				got[set.Name] = append(got[set.Name], m.Name)
+			}
+		}
+		return got
+	}
+
+	expected := map[string][]string{
+		"":        {"0001_20240101_1200_core"},
+		"auth":    {"0001_20240101_1200_users"},
+		"billing": {"0001_20240101_1200_invoices", "0002_20240101_1201_payments"},
+	}
+	if diff := cmp.Diff(names(sets), expected); diff != "" {
+		t.Fatal(diff)
+	}
+
+	ordered, err := sets.Ordered([]string{"billing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	for _, set := range ordered {
+		order = append(order, set.Name)
+	}
+	if diff := cmp.Diff(order, []string{"billing", "", "auth"}); diff != "" {
+		t.Fatal(diff)
+	}
+
+	if _, err := sets.Ordered([]string{"missing"}); err == nil {
+		t.Fatal("Expected error for unknown set")
+	}
+
+	// MigrationsFromFS only reads the default set.
+	migs, err := migrations.MigrationsFromFS(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migs) != 1 {
+		t.Fatalf("Expected 1 migration, got %d", len(migs))
+	}
+
+	if err := migrations.LintFS(source); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationSets_ApplyAll(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	sets, err := migrations.MigrationSetsFromFS(os.DirFS("testdata/setmigrations"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sets.ApplyAll(ctx, db, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := make(map[string]int)
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		for _, set := range sets {
+			v, err := migrations.QuerySetSchemaVersion(ctx, tx, set.Name)
+			if err != nil {
+				return err
+			}
+			versions[set.Name] = v
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(versions, map[string]int{"": 1, "auth": 1, "billing": 2}); diff != "" {
+		t.Fatal(diff)
+	}
+
+	if err := sets.Find("billing").Migrations.MigrateTo(ctx, db, 0, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := utils.QueryAllTableNames(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt := cmpopts.SortSlices(func(a, b string) bool { return a < b })
+	if diff := cmp.Diff(got, []string{"schema_migrations", "schema_repeatable_migrations", "core", "users"}, opt); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMigrationsFromFS_singleFile(t *testing.T) {
+	source := fstest.MapFS{
+		"0001_20210726_2134_first/up.sql":   {Data: []byte("CREATE TABLE one ();\n")},
+		"0001_20210726_2134_first/down.sql": {Data: []byte("DROP TABLE one;\n")},
+		"0002_20210726_2134_second.sql": {Data: []byte(
+			"-- Second migration.\n-- +up\nCREATE TABLE second ();\n\n-- +down\nDROP TABLE second;\n",
+		)},
+		"0003_20210726_2134_third.sql": {Data: []byte(
+			"-- dino:no-transaction\n-- +up\nCREATE INDEX CONCURRENTLY i ON second (id);\n-- +down\nDROP INDEX CONCURRENTLY i;\n",
+		)},
+		"README.md": {Data: []byte("Not a migration.\n")},
+	}
+
+	got, err := migrations.MigrationsFromFS(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := migrations.MigrationSlice{{
+		Name: "0001_20210726_2134_first",
+		Num:  1,
+		Up:   "CREATE TABLE one ();\n",
+		Down: "DROP TABLE one;\n",
+	}, {
+		Name: "0002_20210726_2134_second",
+		Num:  2,
+		Up:   "CREATE TABLE second ();\n\n",
+		Down: "DROP TABLE second;\n",
+	}, {
+		Name:          "0003_20210726_2134_third",
+		Num:           3,
+		Up:            "CREATE INDEX CONCURRENTLY i ON second (id);\n",
+		Down:          "DROP INDEX CONCURRENTLY i;\n",
+		NoTransaction: true,
+	}}
+
+	if diff := cmp.Diff(got, expected); diff != "" {
+		t.Fatal(diff)
+	}
+
+	source["0004_20210726_2134_broken.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE broken ();\n")}
+	if _, err := migrations.MigrationsFromFS(source); err == nil {
+		t.Fatal("Expected error for a file without section markers")
+	}
+}
+
+func TestMigrationSlice_CreateNextFile(t *testing.T) {
+	tmp := t.TempDir()
+
+	m, err := migrations.MigrationSlice{}.CreateNextFile(tmp, "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := migrations.MigrationSlice{{
+		Name: m.Name,
+		Num:  1,
+		Up:   "\n",
+	}}
+
+	if diff := cmp.Diff(got, expected); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMigrationSlice_CreateNext_template(t *testing.T) {
+	tmpl := &migrations.Template{
+		Up: `-- {{.Name}} by {{.Author}} ({{.Ticket}})
+SET lock_timeout = '5s';
+{{if .Table}}
+CREATE TABLE {{.Table}} (
+    id SERIAL PRIMARY KEY
+);
+{{end}}`,
+		Down: `{{if .Table}}DROP TABLE {{.Table}};
+{{end}}`,
+	}
+
+	tmp := t.TempDir()
+	opts := []migrations.Option{
+		migrations.OptionTemplate(tmpl),
+		migrations.OptionTemplateInfo("ville", "DINO-42"),
+	}
+
+	if _, err := (migrations.MigrationSlice{}).CreateNext(tmp, "create_users", opts...); err != nil {
+		t.Fatal(err)
+	}
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migs.CreateNextFile(tmp, "add_index", opts...); err != nil {
+		t.Fatal(err)
+	}
+
+	migs, err = migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := migrations.MigrationSlice{{
+		Name: migs[0].Name,
+		Num:  1,
+		Up: "-- " + migs[0].Name + " by ville (DINO-42)\nSET lock_timeout = '5s';\n\n" +
+			"CREATE TABLE users (\n    id SERIAL PRIMARY KEY\n);\n",
+		Down: "DROP TABLE users;\n",
+	}, {
+		Name: migs[1].Name,
+		Num:  2,
+		Up:   "-- " + migs[1].Name + " by ville (DINO-42)\nSET lock_timeout = '5s';\n\n",
+	}}
+
+	if diff := cmp.Diff(migs, expected); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMigrationSlice_CreateNext_timestamp(t *testing.T) {
+	tmp := t.TempDir()
+
+	if _, err := (migrations.MigrationSlice{}).CreateNext(tmp, "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().UTC().Truncate(time.Second)
+	if _, err := migs.CreateNext(tmp, "second", migrations.OptionVersioning(migrations.VersioningTimestamp)); err != nil {
+		t.Fatal(err)
+	}
+
+	migs, err = migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := time.Parse("20060102150405", strconv.Itoa(migs[1].Num))
+	if err != nil {
+		t.Fatalf("Expected a timestamp number, got %d", migs[1].Num)
+	}
+
+	if created.Before(before) || created.After(time.Now().UTC()) {
+		t.Fatalf("Unexpected timestamp: %v", created)
+	}
+
+	// The date in the name is in UTC too.
+	if !strings.Contains(migs[1].Name, created.Format("20060102_1504")) {
+		t.Fatalf("Name %q does not match the number %d", migs[1].Name, migs[1].Num)
+	}
+
+	// Timestamps are not gaps in the numbering.
+	if err := migs.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationSlice_ApplyAll_outOfOrder(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	migs := migrations.MigrationSlice{{
+		Name: "20240101120000_20240101_1200_users",
+		Num:  20240101120000,
+		Up:   "CREATE TABLE users (id INTEGER);",
+		Down: "DROP TABLE users;",
+	}, {
+		Name: "20240102120000_20240102_1200_late",
+		Num:  20240102120000,
+		Up:   "CREATE TABLE late (id INTEGER);",
+		Down: "DROP TABLE late;",
+	}, {
+		Name: "20240103120000_20240103_1200_orders",
+		Num:  20240103120000,
+		Up:   "CREATE TABLE orders (id INTEGER);",
+		Down: "DROP TABLE orders;",
+	}}
+
+	onMain := migrations.MigrationSlice{migs[0], migs[2]}
+	if err := onMain.ApplyAll(db, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	var outOfOrder *migrations.OutOfOrderError
+	err := migs.ApplyAll(db, log.Default())
+	if !errors.As(err, &outOfOrder) {
+		t.Fatalf("Expected *OutOfOrderError, got %v", err)
+	}
+
+	if outOfOrder.Version != migs[2].Num || len(outOfOrder.Migrations) != 1 || outOfOrder.Migrations[0] != migs[1] {
+		t.Fatalf("Unexpected error: %v", outOfOrder)
+	}
+
+	if err := migs.ApplyAll(db, log.Default(), migrations.OptionAllowOutOfOrder(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		status, err := migs.Status(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		if pending := status.Pending(); len(pending) != 0 {
+			return fmt.Errorf("Expected no pending migrations, got %v", pending)
+		}
+
+		// Reverting goes by the migration numbers.
+		plan, err := migs.RevertPlan(ctx, tx, 2)
+		if err != nil {
+			return err
+		}
+
+		if diff := cmp.Diff(plan, migrations.MigrationSlice{migs[2], migs[1]}); diff != "" {
+			return errors.New(diff)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationSlice_RenumberPlan(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	tmp := t.TempDir()
+	files := map[string]string{
+		"0001_20240101_1200_users/up.sql":    "CREATE TABLE users (id INTEGER);",
+		"0001_20240101_1200_users/down.sql":  "DROP TABLE users;",
+		"0002_20240102_1200_orders/up.sql":   "CREATE TABLE orders (id INTEGER);",
+		"0002_20240102_1200_orders/down.sql": "DROP TABLE orders;",
+		"0002_20240103_1200_items.sql":       "-- +up\nCREATE TABLE items (id INTEGER);\n-- +down\nDROP TABLE items;\n",
+	}
+
+	writeFiles(t, tmp, files)
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The branch with items was merged and applied first.
+	applied := migrations.MigrationSlice{migs[0], migs[2]}
+	if err := applied.ApplyAll(db, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	var renames []migrations.Rename
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		renames, err = migs.RenumberPlan(ctx, tx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []migrations.Rename{
+		{From: "0002_20240102_1200_orders", To: "0003_20240102_1200_orders", Num: 3},
+	}
+
+	if diff := cmp.Diff(renames, expected); diff != "" {
+		t.Fatal(diff)
+	}
+
+	if err := migrations.RenameMigrations(tmp, renames); err != nil {
+		t.Fatal(err)
+	}
+
+	migs, err = migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migs.ApplyAll(db, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationSlice_RenumberPlan_afterSquash(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	tmp := t.TempDir()
+	writeFiles(t, tmp, map[string]string{
+		"0001_20240101_1200_users.sql":  "-- +up\nCREATE TABLE users (id INTEGER);\n-- +down\nDROP TABLE users;\n",
+		"0002_20240102_1200_orders.sql": "-- +up\nCREATE TABLE orders (id INTEGER);\n-- +down\nDROP TABLE orders;\n",
+		"0003_20240103_1200_items.sql":  "-- +up\nCREATE TABLE items (id INTEGER);\n-- +down\nDROP TABLE items;\n",
+	})
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Migrated before the squash.
+	if err := migs.ApplyAll(db, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	schema := "CREATE TABLE users (id INTEGER);\nCREATE TABLE orders (id INTEGER);\nCREATE TABLE items (id INTEGER);\n"
+	if _, err := migs.Squash(tmp, 3, schema); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two branches both added migration 4 after the squash.
+	writeFiles(t, tmp, map[string]string{
+		"0004_20240104_1200_carts.sql":    "-- +up\nCREATE TABLE carts (id INTEGER);\n-- +down\nDROP TABLE carts;\n",
+		"0004_20240105_1200_payments.sql": "-- +up\nCREATE TABLE payments (id INTEGER);\n-- +down\nDROP TABLE payments;\n",
+	})
+
+	migs, err = migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var renames []migrations.Rename
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		renames, err = migs.RenumberPlan(ctx, tx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []migrations.Rename{
+		{From: "0004_20240105_1200_payments", To: "0005_20240105_1200_payments", Num: 5},
+	}
+
+	if diff := cmp.Diff(renames, expected); diff != "" {
+		t.Fatal(diff)
+	}
+
+	if err := migrations.RenameMigrations(tmp, renames); err != nil {
+		t.Fatal(err)
+	}
+
+	migs, err = migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migs.ApplyAll(db, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationSlice_Squash(t *testing.T) {
+	ctx := context.Background()
+
+	tmp := t.TempDir()
+	writeFiles(t, tmp, map[string]string{
+		"0001_20240101_1200_users/up.sql":    "CREATE TABLE users (id INTEGER);",
+		"0001_20240101_1200_users/down.sql":  "DROP TABLE users;",
+		"0002_20240102_1200_orders/up.sql":   "CREATE TABLE orders (id INTEGER);",
+		"0002_20240102_1200_orders/down.sql": "DROP TABLE orders;",
+		"0003_20240103_1200_items.sql":       "-- +up\nCREATE TABLE items (id INTEGER);\n-- +down\nDROP TABLE items;\n",
+	})
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migratedParams := createTestDB(t, "_migrated")
+	migrated := dbtest.OpenDB(t, ctx, migratedParams)
+	if err := migs[:2].ApplyAll(migrated, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	behind := dbtest.OpenDB(t, ctx, createTestDB(t, "_behind"))
+	if err := migs[:1].ApplyAll(behind, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The baseline runs a real dump, so that the migrations after it in the
+	// same run are checked to work with what the dump leaves behind.
+	schema, err := fixtures.DumpSchema(migratedParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migs.Squash(tmp, 2, string(schema)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrations.LintFS(os.DirFS(tmp)); err != nil {
+		t.Fatal(err)
+	}
+
+	archived, err := os.ReadDir(tmp + "/.archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archived) != 2 {
+		t.Fatalf("Expected 2 archived migrations, got %d", len(archived))
+	}
+
+	migs, err = migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migs) != 2 || !migs[0].Baseline || migs[0].Num != 2 {
+		t.Fatalf("Expected a baseline and a migration, got %v", migs)
+	}
+
+	t.Run("migrated", func(t *testing.T) {
+		if err := migs.ApplyAll(migrated, log.Default()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("fresh", func(t *testing.T) {
+		fresh := openTestDB(t)
+		if err := migs.ApplyAll(fresh, log.Default()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("behind", func(t *testing.T) {
+		if err := migs.ApplyAll(behind, log.Default()); err == nil {
+			t.Fatal("Expected an error")
+		}
+	})
+}
+
+func TestMigrationSlice_CreateNext_afterSquash(t *testing.T) {
+	tmp := t.TempDir()
+	writeFiles(t, tmp, map[string]string{
+		"0001_20240101_1200_users.sql":  "-- +up\nCREATE TABLE users (id INTEGER);\n-- +down\nDROP TABLE users;\n",
+		"0002_20240102_1200_orders.sql": "-- +up\nCREATE TABLE orders (id INTEGER);\n-- +down\nDROP TABLE orders;\n",
+		"0003_20240103_1200_items.sql":  "-- +up\nCREATE TABLE items (id INTEGER);\n-- +down\nDROP TABLE items;\n",
+	})
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migs.Squash(tmp, 3, "CREATE TABLE users (id INTEGER);\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	migs, err = migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := migs.NextNum(); got != 4 {
+		t.Fatalf("Expected next num 4, got %d", got)
+	}
+
+	if _, err := migs.CreateNext(tmp, "next"); err != nil {
+		t.Fatal(err)
+	}
+
+	migs, err = migrations.MigrationsFromFS(os.DirFS(tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migs.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Creates a database for the test, named after the test and suffix, and
+// returns the parameters for connecting to it. The database is dropped after
+// the test.
+func createTestDB(t *testing.T, suffix string) *utils.ConnectionParams {
+	t.Helper()
+
+	connParams := dbtest.DefaultConnectionParams
+	dbname := strings.NewReplacer("/", "_", " ", "_").Replace(strings.ToLower(t.Name())) + suffix
+
+	return dbtest.WithCreateDB(t, context.Background(), &connParams, dbname)
+}
+
+// Creates a database for the test and opens a pool to it.
+func openTestDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	return dbtest.OpenDB(t, context.Background(), createTestDB(t, ""))
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for fname, contents := range files {
+		if err := os.MkdirAll(path.Dir(dir+"/"+fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(dir+"/"+fname, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrationSlice_ApplyAll_repeatable(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	tmp := t.TempDir()
+	writeFiles(t, tmp, map[string]string{
+		"0001_20240101_1200_users/up.sql":   "CREATE TABLE users (id INTEGER, active BOOLEAN);",
+		"0001_20240101_1200_users/down.sql": "DROP TABLE users;",
+		"repeatable/active_users.sql":       "CREATE OR REPLACE VIEW active_users AS SELECT id FROM users WHERE active;",
+	})
+
+	apply := func() migrations.MigrationSlice {
+		t.Helper()
+
+		migs, err := migrations.MigrationsFromFS(os.DirFS(tmp))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var plan migrations.MigrationSlice
+		err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+			if err := migrations.EnsureSchema(ctx, tx); err != nil {
+				return err
+			}
+
+			plan, err = migs.ApplyPlan(ctx, tx)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := migs.ApplyAll(db, log.Default()); err != nil {
+			t.Fatal(err)
+		}
+
+		return plan
+	}
+
+	names := func(slice migrations.MigrationSlice) []string {
+		var names []string
+		for _, m := range slice {
+			names = append(names, m.Name)
+		}
+
+		return names
+	}
+
+	if diff := cmp.Diff(names(apply()), []string{"0001_20240101_1200_users", "active_users"}); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// Unchanged repeatable migrations are not re-run.
+	if plan := apply(); len(plan) != 0 {
+		t.Fatalf("Expected an empty plan, got %v", names(plan))
+	}
+
+	writeFiles(t, tmp, map[string]string{
+		"repeatable/active_users.sql": "CREATE OR REPLACE VIEW active_users AS SELECT id, active FROM users WHERE active;",
+	})
+
+	if diff := cmp.Diff(names(apply()), []string{"active_users"}); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMigrationSlice_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("reversible", func(t *testing.T) {
+		db := openTestDB(t)
+		dbtest.RoundTrip(t, ctx, db, migs)
+	})
+
+	t.Run("not reversible", func(t *testing.T) {
+		db := openTestDB(t)
+
+		broken := *migs[1]
+		broken.Down = "SELECT 1;"
+		migs := migrations.MigrationSlice{migs[0], &broken, migs[2]}
+
+		var rtErr *migrations.RoundTripError
+		if err := migs.RoundTrip(ctx, db, log.Default()); !errors.As(err, &rtErr) {
+			t.Fatalf("Expected *RoundTripError, got %v", err)
+		}
+
+		if rtErr.Name != broken.Name || rtErr.Reapply {
+			t.Fatalf("Unexpected error: %v", rtErr)
+		}
+	})
+}
+
+func TestLintFS_irreversible(t *testing.T) {
+	file := &fstest.MapFile{Data: []byte("SELECT 1;\n")}
+	empty := &fstest.MapFile{Data: []byte("-- Nothing to do.\n")}
+
+	source := fstest.MapFS{
+		"0001_20240101_1200_empty/up.sql":        file,
+		"0001_20240101_1200_empty/down.sql":      empty,
+		"0002_20240101_1201_marked/up.sql":       file,
+		"0002_20240101_1201_marked/down.sql":     empty,
+		"0002_20240101_1201_marked/irreversible": file,
+		"0003_20240101_1202_empty.sql":           {Data: []byte("-- +up\nSELECT 1;\n-- +down\n")},
+		"0004_20240101_1203_marked.sql":          {Data: []byte("-- +up\nSELECT 1;\n-- +down\n-- dino:irreversible\n")},
+		"0005_20240101_1204_directive/up.sql":    file,
+		"0005_20240101_1204_directive/down.sql":  {Data: []byte("-- dino:irreversible\n")},
+	}
+
+	err := migrations.LintFS(source)
+
+	var verr *migrations.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected ValidationError, got %v", err)
+	}
+
+	expected := []migrations.Problem{
+		{Kind: migrations.ProblemEmptyDown, Path: "0001_20240101_1200_empty/down.sql", Message: "down.sql is empty, add an irreversible file or -- dino:irreversible to it if the migration cannot be reverted", Warning: true},
+		{Kind: migrations.ProblemEmptyDown, Path: "0003_20240101_1202_empty.sql", Message: "down section is empty, add -- dino:irreversible to it if the migration cannot be reverted", Warning: true},
+	}
+
+	if diff := cmp.Diff(verr.Problems, expected); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// Empty down scripts don't prevent applying the migrations.
+	warnings, err := verr.SplitWarnings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(warnings, expected); diff != "" {
+		t.Fatal(diff)
+	}
+
+	migs, err := migrations.MigrationsFromFS(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var irreversible []bool
+	for _, m := range migs {
+		irreversible = append(irreversible, m.Irreversible)
+	}
+
+	if diff := cmp.Diff(irreversible, []bool{false, true, false, true, true}); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestLintFS_createNext(t *testing.T) {
+	tmp := t.TempDir()
+
+	if _, err := (migrations.MigrationSlice{}).CreateNext(tmp, "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The empty down.sql of a new migration is only a warning.
+	var verr *migrations.ValidationError
+	if err := migrations.LintFS(os.DirFS(tmp)); !errors.As(err, &verr) {
+		t.Fatalf("Expected ValidationError, got %v", err)
+	}
+
+	if _, err := verr.SplitWarnings(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationSlice_RevertCurrent_irreversible(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migs[1].Irreversible = true
+
+	if err := migs.ApplyAll(db, log.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		if _, err := migs.RevertPlan(ctx, tx, 1); err != nil {
+			return fmt.Errorf("Expected the latest migration to be reversible: %v", err)
+		}
+
+		if _, err := migs.RevertPlan(ctx, tx, 2); err == nil {
+			return errors.New("Expected reverting past the irreversible migration to fail")
+		}
+
+		if err := migs.RevertCurrent(ctx, tx); err != nil {
+			return err
+		}
+
+		if err := migs.RevertCurrent(ctx, tx); err == nil || !strings.Contains(err.Error(), "irreversible") {
+			return fmt.Errorf("Expected an irreversible error, got %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type recordingHooks struct {
+	migrations.NoopHooks
+	calls   []string
+	webhook string
+}
+
+func (h *recordingHooks) BeforeRun(ctx context.Context, tx pgx.Tx, run *migrations.RunInfo) error {
+	h.calls = append(h.calls, fmt.Sprintf("before run (%d)", len(run.Migrations)))
+	return nil
+}
+
+func (h *recordingHooks) AfterRun(ctx context.Context, tx pgx.Tx, run *migrations.RunInfo) error {
+	h.calls = append(h.calls, "after run")
+
+	if run.Duration <= 0 {
+		return errors.New("Expected the run duration to be set")
+	}
+
+	resp, err := http.Post(h.webhook, "text/plain", strings.NewReader(fmt.Sprintf("%d migration(s)", len(run.Migrations))))
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (h *recordingHooks) AfterMigration(ctx context.Context, tx pgx.Tx, m *migrations.Migration, info migrations.MigrationInfo) error {
+	h.calls = append(h.calls, fmt.Sprintf("after %s (down: %v)", m.Name, info.Down))
+
+	// The hook runs in the migration's transaction.
+	_, err := tx.Exec(ctx, `SELECT 1 FROM schema_migrations WHERE num = $1`, m.Num)
+	return err
+}
+
+func TestMigrationSlice_ApplyAll_hooks(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	// The handler runs on the server's goroutines.
+	var mu sync.Mutex
+	var notifications []string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		notifications = append(notifications, string(body))
+	}))
+	defer webhook.Close()
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hooks := &recordingHooks{webhook: webhook.URL}
+
+	if err := migs[:2].ApplyAll(db, log.Default(), migrations.OptionHooks(hooks)); err != nil {
+		t.Fatal(err)
+	}
+
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		return migs.RevertSteps(ctx, tx, 2, migrations.OptionHooks(hooks))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The run hooks are called once around the reverted migrations.
+	expected := []string{
+		"before run (2)",
+		"after 0001_20210726_2134_first (down: false)",
+		"after 0002_20210726_2134_second (down: false)",
+		"after run",
+		"before run (2)",
+		"after 0002_20210726_2134_second (down: true)",
+		"after 0001_20210726_2134_first (down: true)",
+		"after run",
+	}
+
+	if diff := cmp.Diff(hooks.calls, expected); diff != "" {
+		t.Fatal(diff)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if diff := cmp.Diff(notifications, []string{"2 migration(s)", "2 migration(s)"}); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMigrationSlice_ApplyAll_events(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []migrations.Event
+	opt := migrations.OptionEvents(func(e migrations.Event) {
+		events = append(events, e)
+	})
+
+	if err := migs[:2].ApplyAll(db, log.Default(), opt); err != nil {
+		t.Fatal(err)
+	}
+
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		return migs.RevertCurrent(ctx, tx, opt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := migrations.MigrationSlice{
+		migs[0],
+		migs[1],
+		{Name: "0003_broken", Num: 3, Up: "CREATE TABLE three (id SERIAL PRIMARY KEY); SELECT * FROM nope;"},
+	}
+	if err := failing.ApplyAll(db, log.Default(), opt); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	expected := []migrations.Event{
+		{Kind: migrations.EventMigrationStarted, Name: "0001_20210726_2134_first", Num: 1, Statements: 1},
+		{Kind: migrations.EventMigrationFinished, Name: "0001_20210726_2134_first", Num: 1, Statements: 1},
+		{Kind: migrations.EventMigrationStarted, Name: "0002_20210726_2134_second", Num: 2, Statements: 1},
+		{Kind: migrations.EventMigrationFinished, Name: "0002_20210726_2134_second", Num: 2, Statements: 1},
+		{Kind: migrations.EventMigrationStarted, Name: "0002_20210726_2134_second", Num: 2, Down: true, Statements: 1},
+		{Kind: migrations.EventMigrationFinished, Name: "0002_20210726_2134_second", Num: 2, Down: true, Statements: 1},
+		{Kind: migrations.EventMigrationStarted, Name: "0002_20210726_2134_second", Num: 2, Statements: 1},
+		{Kind: migrations.EventMigrationFinished, Name: "0002_20210726_2134_second", Num: 2, Statements: 1},
+		{Kind: migrations.EventMigrationStarted, Name: "0003_broken", Num: 3, Statements: 2},
+		{Kind: migrations.EventMigrationFailed, Name: "0003_broken", Num: 3, Statements: 2},
+	}
+
+	if diff := cmp.Diff(events, expected, cmpopts.IgnoreFields(migrations.Event{}, "Duration", "Err")); diff != "" {
+		t.Fatal(diff)
+	}
+
+	if events[len(events)-1].Err == nil {
+		t.Fatal("expected the failed event to carry the error")
+	}
+}
+
+func TestSlogEvents(t *testing.T) {
+	var buf strings.Builder
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	handler := migrations.SlogEvents(logger)
+	handler(migrations.Event{Kind: migrations.EventMigrationStarted, Name: "0001_first", Num: 1, Statements: 2})
+	handler(migrations.Event{Kind: migrations.EventMigrationFailed, Name: "0001_first", Num: 1, Statements: 2, Duration: time.Second, Err: errors.New("boom")})
+
+	expected := `{"level":"INFO","msg":"Migration started","event":"migration_started","set":"","name":"0001_first","num":1,"down":false,"no_transaction":false,"statements":2}
+{"level":"ERROR","msg":"Migration failed","event":"migration_failed","set":"","name":"0001_first","num":1,"down":false,"no_transaction":false,"statements":2,"duration":1000000000,"error":"boom"}
+`
+
+	if diff := cmp.Diff(buf.String(), expected); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	check := func() error {
+		return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+			return migrations.CheckSchema(ctx, tx)
+		})
+	}
+
+	if err := check(); !errors.Is(err, migrations.ErrSchemaOutdated) {
+		t.Fatalf("Expected ErrSchemaOutdated for an empty database, got %v", err)
+	}
+
+	_, err := db.Exec(ctx, `
+		CREATE TABLE schema_version (version INTEGER NOT NULL DEFAULT 0);
+		INSERT INTO schema_version VALUES (1);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := check(); !errors.Is(err, migrations.ErrSchemaOutdated) {
+		t.Fatalf("Expected ErrSchemaOutdated for a legacy database, got %v", err)
+	}
+
+	// Reverting needs the upgraded tables.
+	migs, err := migrations.MigrationsFromFS(os.DirFS(testmigrationsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		return migs.RevertCurrent(ctx, tx)
+	})
+	if !errors.Is(err, migrations.ErrSchemaOutdated) {
+		t.Fatalf("Expected ErrSchemaOutdated from RevertCurrent, got %v", err)
+	}
+
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		_, err := migs.RevertPlan(ctx, tx, 1)
+		return err
+	})
+	if !errors.Is(err, migrations.ErrSchemaOutdated) {
+		t.Fatalf("Expected ErrSchemaOutdated from RevertPlan, got %v", err)
+	}
+
+	// Checking doesn't upgrade the legacy table.
+	rows, err := db.Query(ctx, `SELECT to_regclass('schema_version') IS NOT NULL`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy, err := pgx.CollectOneRow(rows, pgx.RowTo[bool])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !legacy {
+		t.Fatal("Expected schema_version to be left in place")
+	}
+
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		return migrations.EnsureSchema(ctx, tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := check(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensuring an up to date schema doesn't lock the table.
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		if err := migrations.EnsureSchema(ctx, tx); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(ctx, `
+			SELECT count(*) FROM pg_locks
+			WHERE pid = pg_backend_pid()
+			AND relation = 'schema_migrations'::regclass
+			AND mode = 'AccessExclusiveLock'
+		`)
+		if err != nil {
+			return err
+		}
+
+		locks, err := pgx.CollectOneRow(rows, pgx.RowTo[int])
+		if err != nil {
+			return err
+		}
+
+		if locks != 0 {
+			return fmt.Errorf("Expected no exclusive locks on schema_migrations, got %d", locks)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,163 @@
+package migrations
+
+import (
+	"log"
+	"time"
+)
+
+// Default key for the advisory lock held while migrating.
+const DefaultLockKey int64 = 0x64696e6f
+
+// Default time to wait for the advisory lock.
+const DefaultLockTimeout = 5 * time.Minute
+
+// TransactionMode controls how ApplyAll and MigrateTo wrap migrations into
+// transactions.
+type TransactionMode int
+
+const (
+	// All the migrations of a run share a single transaction.
+	TransactionSingle TransactionMode = iota
+	// Each migration is committed on its own, so a failure only rolls back
+	// the failed migration.
+	TransactionPerMigration
+)
+
+// Versioning controls how new migrations are numbered.
+type Versioning int
+
+const (
+	// New migrations are numbered one after the other (0001, 0002, ...).
+	VersioningSequential Versioning = iota
+	// New migrations are numbered with their UTC creation time
+	// (YYYYMMDDHHMMSS), so migrations created on parallel branches don't
+	// collide.
+	VersioningTimestamp
+)
+
+type options struct {
+	logger           Logger
+	lockKey          int64
+	lockTimeout      time.Duration
+	transactionMode  TransactionMode
+	statementTimeout time.Duration
+	template         *Template
+	author           string
+	ticket           string
+	versioning       Versioning
+	allowOutOfOrder  bool
+	hooks            hookList
+	events           EventHandler
+}
+
+func newOptions(opts ...Option) *options {
+	// Initialize with default values.
+	options := &options{
+		logger:          log.Default(),
+		lockKey:         DefaultLockKey,
+		lockTimeout:     DefaultLockTimeout,
+		transactionMode: TransactionSingle,
+	}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return options
+}
+
+type Option func(*options)
+
+// Set the logger. Ignored by functions that take the logger as an argument.
+func OptionLogger(logger Logger) Option {
+	return func(opts *options) {
+		opts.logger = logger
+	}
+}
+
+// Set the key of the advisory lock that guards against concurrent migration
+// runs.
+func OptionLockKey(key int64) Option {
+	return func(opts *options) {
+		opts.lockKey = key
+	}
+}
+
+// Set how long to wait for the advisory lock. Zero waits indefinitely.
+func OptionLockTimeout(d time.Duration) Option {
+	return func(opts *options) {
+		opts.lockTimeout = d
+	}
+}
+
+// Set the transaction mode.
+func OptionTransactionMode(mode TransactionMode) Option {
+	return func(opts *options) {
+		opts.transactionMode = mode
+	}
+}
+
+// Set the statement timeout used while migrating. Zero uses the database's
+// default.
+func OptionStatementTimeout(d time.Duration) Option {
+	return func(opts *options) {
+		opts.statementTimeout = d
+	}
+}
+
+// Set the template for new migrations.
+func OptionTemplate(t *Template) Option {
+	return func(opts *options) {
+		opts.template = t
+	}
+}
+
+// Set the author and ticket made available to the migration template.
+func OptionTemplateInfo(author, ticket string) Option {
+	return func(opts *options) {
+		opts.author = author
+		opts.ticket = ticket
+	}
+}
+
+// Set how new migrations are numbered.
+func OptionVersioning(v Versioning) Option {
+	return func(opts *options) {
+		opts.versioning = v
+	}
+}
+
+// Set whether pending migrations older than the latest applied migration
+// (e.g. ones merged late from a parallel branch) are applied. By default they
+// are reported with *OutOfOrderError instead.
+func OptionAllowOutOfOrder(allow bool) Option {
+	return func(opts *options) {
+		opts.allowOutOfOrder = allow
+	}
+}
+
+// Add hooks called around migration runs and each migration. Hooks are
+// called in the order they are added.
+func OptionHooks(hooks ...Hooks) Option {
+	return func(opts *options) {
+		opts.hooks = append(opts.hooks, hooks...)
+	}
+}
+
+// Set the handler of the events of migration runs, e.g. SlogEvents. By default
+// the events are written to the logger with LoggerEvents.
+func OptionEvents(handler EventHandler) Option {
+	return func(opts *options) {
+		opts.events = handler
+	}
+}
+
+// Sends the event to the event handler, or to the logger if none is set.
+func (o *options) emit(e Event) {
+	if o.events != nil {
+		o.events(e)
+		return
+	}
+
+	LoggerEvents(o.logger)(e)
+}
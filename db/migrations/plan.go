@@ -0,0 +1,208 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const goMigrationComment = "-- Go migration, no SQL to show.\n"
+
+// OutOfOrderError is returned when pending migrations are older than the
+// latest applied migration, e.g. when a migration from a parallel branch is
+// merged after newer migrations have been applied. Use OptionAllowOutOfOrder
+// to apply them anyway.
+type OutOfOrderError struct {
+	// Number of the latest applied migration.
+	Version    int
+	Migrations MigrationSlice
+}
+
+func (e *OutOfOrderError) Error() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%d pending migration(s) are older than the latest applied migration %d:", len(e.Migrations), e.Version)
+	for _, m := range e.Migrations {
+		fmt.Fprintf(&b, "\n  %s", m.Name)
+	}
+
+	return b.String()
+}
+
+// Returns the migrations that ApplyAll would apply, in the order they would be
+// applied. All the migrations that are not recorded as applied are included,
+// so gaps left by migrations applied out of order are filled. They are
+// followed by the repeatable migrations that have changed.
+//
+// Returns *OutOfOrderError if any of them are older than the latest applied
+// migration, unless OptionAllowOutOfOrder is given.
+//
+// The migrations are checked with Validate and Verify first, as in ApplyAll.
+// The database is not changed, and EnsureSchema need not have been run, see
+// Status.
+func (slice MigrationSlice) ApplyPlan(ctx context.Context, tx pgx.Tx, opts ...Option) (MigrationSlice, error) {
+	if err := slice.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := slice.Verify(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	return slice.applyAllPlan(ctx, tx, newOptions(opts...))
+}
+
+func (slice MigrationSlice) applyAllPlan(ctx context.Context, tx pgx.Tx, o *options) (MigrationSlice, error) {
+	plan, err := slice.applyPlan(ctx, tx, math.MaxInt, o)
+	if err != nil {
+		return nil, err
+	}
+
+	repeatable, err := slice.repeatablePlan(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(plan, repeatable...), nil
+}
+
+// Returns the repeatable migrations that have changed since they were last
+// applied.
+func (slice MigrationSlice) repeatablePlan(ctx context.Context, tx pgx.Tx) (MigrationSlice, error) {
+	checksums, err := queryRepeatableChecksums(ctx, tx, slice.set())
+	if err != nil {
+		return nil, err
+	}
+
+	var plan MigrationSlice
+	for _, m := range slice {
+		if m.Repeatable && checksums[m.Name] != checksum(m.Up) {
+			plan = append(plan, m)
+		}
+	}
+
+	return plan, nil
+}
+
+// Returns the pending numbered migrations up to and including target.
+func (slice MigrationSlice) applyPlan(ctx context.Context, tx pgx.Tx, target int, o *options) (MigrationSlice, error) {
+	versions, err := querySetVersions(ctx, tx, slice.set())
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]bool, len(versions))
+	current := 0
+	for _, v := range versions {
+		applied[v] = true
+		current = v
+	}
+
+	// Fresh databases start from the baseline, and databases migrated to it
+	// (or past it) with the squashed migrations are compatible with it.
+	if b := slice.baseline(); b != nil && len(versions) > 0 && !applied[b.Num] {
+		return nil, fmt.Errorf(
+			"Database is at version %d, but the migrations start from baseline '%s', apply the archived migrations up to %d first",
+			current, b.Name, b.Num,
+		)
+	}
+
+	var plan, outOfOrder MigrationSlice
+	for _, m := range slice.numbered() {
+		if applied[m.Num] || m.Num > target {
+			continue
+		}
+
+		if m.Num < current {
+			outOfOrder = append(outOfOrder, m)
+		}
+
+		plan = append(plan, m)
+	}
+
+	if len(outOfOrder) > 0 {
+		if !o.allowOutOfOrder {
+			return nil, &OutOfOrderError{Version: current, Migrations: outOfOrder}
+		}
+
+		for _, m := range outOfOrder {
+			o.logger.Printf("Migration '%s' is older than the latest applied migration %d, applying it out of order", m.Name, current)
+		}
+	}
+
+	return plan, nil
+}
+
+// Returns the migrations that RevertSteps would revert, in the order they
+// would be reverted. Negative steps means all the applied migrations. Returns
+// ErrSchemaOutdated like RevertSteps.
+func (slice MigrationSlice) RevertPlan(ctx context.Context, tx pgx.Tx, steps int) (MigrationSlice, error) {
+	if err := CheckSchema(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	return slice.revertPlan(ctx, tx, steps, 0)
+}
+
+// Returns at most steps (negative means no limit) applied migrations newer
+// than target, newest first.
+func (slice MigrationSlice) revertPlan(ctx context.Context, tx pgx.Tx, steps, target int) (MigrationSlice, error) {
+	versions, err := querySetVersions(ctx, tx, slice.set())
+	if err != nil {
+		return nil, err
+	}
+
+	var plan MigrationSlice
+	for i := len(versions) - 1; i >= 0 && versions[i] > target && (steps < 0 || len(plan) < steps); i-- {
+		m := slice.Find(versions[i])
+		if m == nil {
+			return nil, fmt.Errorf("Migration %d not found (corrupted state)", versions[i])
+		}
+
+		if err := m.checkReversible(); err != nil {
+			return nil, err
+		}
+
+		plan = append(plan, m)
+	}
+
+	return plan, nil
+}
+
+// Writes the up scripts of the migrations to w, each preceded by a comment
+// naming the migration. Go migrations are written as a comment.
+func (slice MigrationSlice) WriteUpSQL(w io.Writer) error {
+	for _, m := range slice {
+		up := m.Up
+		if m.UpFunc != nil {
+			up = goMigrationComment
+		}
+
+		if _, err := fmt.Fprintf(w, "-- Apply %s\n%s\n", m.Name, up); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes the down scripts of the migrations to w, each preceded by a comment
+// naming the migration. Go migrations are written as a comment.
+func (slice MigrationSlice) WriteDownSQL(w io.Writer) error {
+	for _, m := range slice {
+		down := m.Down
+		if m.DownFunc != nil {
+			down = goMigrationComment
+		}
+
+		if _, err := fmt.Fprintf(w, "-- Revert %s\n%s\n", m.Name, down); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Rename of a migration, as planned by RenumberPlan.
+type Rename struct {
+	From string
+	To   string
+	Num  int
+}
+
+// RenumberPlan returns the renames needed to number the migrations one after
+// the other starting from 1, e.g. after two branches both added migration
+// 0015. The migrations applied to the database keep their place in front, and
+// the rest follow ordered by number and name. The date and name parts of the
+// migration names are preserved. Timestamp numbered migrations are left as
+// they are.
+//
+// With a baseline, the numbering continues from the latest baseline, which is
+// never renamed, so databases migrated before the squash keep matching.
+//
+// Returns an error if a migration applied to the database, or a Go migration,
+// would have to be renamed.
+func (slice MigrationSlice) RenumberPlan(ctx context.Context, tx pgx.Tx) ([]Rename, error) {
+	history, err := querySetHistory(ctx, tx, slice.set())
+	if err != nil {
+		return nil, err
+	}
+
+	byNum := make(map[int]MigrationRecord, len(history))
+	for _, r := range history {
+		byNum[r.Num] = r
+	}
+
+	// Records upgraded from the legacy schema have no names.
+	isApplied := func(m *Migration) bool {
+		r, ok := byNum[m.Num]
+		return ok && (r.Name == m.Name || r.Name == "")
+	}
+
+	ordered := slice.numbered()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if isApplied(a) != isApplied(b) {
+			return isApplied(a)
+		}
+
+		if a.Num != b.Num {
+			return a.Num < b.Num
+		}
+
+		return a.Name < b.Name
+	})
+
+	var renames []Rename
+	num := 0
+	baseline := slice.baseline()
+	if baseline != nil {
+		num = baseline.Num
+	}
+
+	for _, m := range ordered {
+		if isTimestampNum(m.Num) || (baseline != nil && m.Num <= baseline.Num) {
+			continue
+		}
+
+		num++
+		if m.Num == num {
+			continue
+		}
+
+		if isApplied(m) {
+			return nil, fmt.Errorf("Migration '%s' is applied to the database, refusing to renumber it", m.Name)
+		}
+
+		if m.UpFunc != nil {
+			return nil, fmt.Errorf("Go migration '%s' would have to be renumbered, register it with number %d instead", m.Name, num)
+		}
+
+		_, rest, _ := strings.Cut(m.Name, "_")
+		renames = append(renames, Rename{
+			From: m.Name,
+			To:   fmt.Sprintf("%04d_%s", num, rest),
+			Num:  num,
+		})
+	}
+
+	return renames, nil
+}
+
+// Renames the migration directories and single file migrations in baseDir.
+// baseDir should point to the directory where all the migrations of the set
+// live.
+func RenameMigrations(baseDir string, renames []Rename) error {
+	for _, r := range renames {
+		from := migrationPath(baseDir, r.From)
+		to := baseDir + "/" + r.To + strings.TrimPrefix(from, baseDir+"/"+r.From)
+
+		// os.Rename would silently replace a file.
+		if _, err := os.Stat(to); err == nil {
+			return fmt.Errorf("Cannot rename '%s' to '%s': already exists", r.From, r.To)
+		}
+
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/vhakulinen/dino/db/catalog"
+)
+
+// RoundTripError is returned by RoundTrip when a migration is not reversible.
+type RoundTripError struct {
+	Name string
+	// Reapply is set when the schema differs after applying the migration
+	// again, instead of after reverting it.
+	Reapply     bool
+	Differences []catalog.Difference
+}
+
+func (e *RoundTripError) Error() string {
+	var b strings.Builder
+
+	if e.Reapply {
+		fmt.Fprintf(&b, "Applying '%s' again after reverting it does not give the same schema:", e.Name)
+	} else {
+		fmt.Fprintf(&b, "Reverting '%s' does not restore the schema from before applying it:", e.Name)
+	}
+
+	for _, d := range e.Differences {
+		fmt.Fprintf(&b, "\n  %s", d)
+	}
+
+	return b.String()
+}
+
+// RoundTrip checks that the pending migrations are reversible. Each migration
+// is applied, reverted and applied again, and the schema is compared after
+// each step. Returns *RoundTripError for the first migration that is not
+// reversible. Meant to be run against a scratch database.
+//
+// Baselines and irreversible migrations are applied without reverting them,
+// and repeatable migrations are not run. Each step runs in a transaction of
+// its own, except for NoTransaction migrations, which run outside one.
+func (slice MigrationSlice) RoundTrip(ctx context.Context, db applyDB, logger Logger, opts ...Option) error {
+	o := newOptions(opts...)
+	o.logger = logger
+
+	if err := slice.Validate(); err != nil {
+		return err
+	}
+
+	return withLockedConn(ctx, db, o, func(conn applyDB) error {
+		var plan MigrationSlice
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			err := EnsureSchema(ctx, tx)
+			if err != nil {
+				return err
+			}
+
+			plan, err = slice.applyPlan(ctx, tx, math.MaxInt, o)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, m := range plan {
+			if m.Baseline || m.Irreversible {
+				if err := runSteps(ctx, conn, []step{{m: m}}, o); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if err := roundTrip(ctx, conn, m, o); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func roundTrip(ctx context.Context, conn applyDB, m *Migration, o *options) error {
+	before, err := catalog.Snapshot(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	if err := runSteps(ctx, conn, []step{{m: m}}, o); err != nil {
+		return err
+	}
+
+	applied, err := catalog.Snapshot(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	if err := runSteps(ctx, conn, []step{{m: m, down: true}}, o); err != nil {
+		return err
+	}
+
+	reverted, err := catalog.Snapshot(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	if diffs := catalog.Diff(before, reverted); len(diffs) > 0 {
+		return &RoundTripError{Name: m.Name, Differences: diffs}
+	}
+
+	if err := runSteps(ctx, conn, []step{{m: m}}, o); err != nil {
+		return err
+	}
+
+	reapplied, err := catalog.Snapshot(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	if diffs := catalog.Diff(applied, reapplied); len(diffs) > 0 {
+		return &RoundTripError{Name: m.Name, Reapply: true, Differences: diffs}
+	}
+
+	return nil
+}
@@ -2,56 +2,307 @@ package migrations
 
 import (
 	"context"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
 //go:embed schema.sql
 var schema string
 
+// Record of an applied migration, as stored in the schema_migrations table.
+//
+// Records upgraded from the legacy schema_version table have empty Name and
+// checksums, since that information was never stored.
+type MigrationRecord struct {
+	Set          string
+	Num          int
+	Name         string
+	AppliedAt    time.Time
+	AppliedBy    string
+	Duration     time.Duration
+	UpChecksum   string
+	DownChecksum string
+}
+
 // Initializes database for tracking migrations.
+//
+// Databases that still use the legacy single row schema_version table are
+// upgraded into the schema_migrations history table.
 func EnsureSchema(ctx context.Context, tx pgx.Tx) error {
 	_, err := tx.Exec(ctx, schema)
 	if err != nil {
 		return err
 	}
 
-	rows, err := tx.Query(ctx, `SELECT COUNT(*) FROM schema_version`)
+	return upgradeLegacySchema(ctx, tx)
+}
+
+// ErrSchemaOutdated is returned by CheckSchema when the tables tracking
+// migrations are missing or need an upgrade.
+var ErrSchemaOutdated = errors.New("The tables tracking migrations are missing or need an upgrade, apply the migrations to set them up")
+
+// CheckSchema checks, without changing the database, that it's set up for
+// tracking migrations as EnsureSchema would leave it. Returns
+// ErrSchemaOutdated if not.
+func CheckSchema(ctx context.Context, tx pgx.Tx) error {
+	// Keep in sync with the last changes of schema.sql.
+	rows, err := tx.Query(ctx, `
+		SELECT to_regclass('schema_version') IS NULL
+			AND to_regclass('schema_repeatable_migrations') IS NOT NULL
+			AND (
+				SELECT count(*) FROM pg_attribute
+				WHERE attrelid = to_regclass('schema_migrations') AND NOT attisdropped
+				AND (attname::text, format_type(atttypid, NULL)) IN (
+					('num', 'bigint'),
+					('down_checksum', 'text'),
+					('migration_set', 'text')
+				)
+			) = 3
+	`)
 	if err != nil {
 		return err
 	}
 
-	count, err := pgx.CollectOneRow(rows, pgx.RowTo[int])
+	ok, err := pgx.CollectOneRow(rows, pgx.RowTo[bool])
 	if err != nil {
 		return err
 	}
 
-	// If no rows, insert the default value.
-	if count == 0 {
-		_, err = tx.Exec(ctx, `INSERT INTO schema_version VALUES (0)`)
+	if !ok {
+		return ErrSchemaOutdated
+	}
+
+	return nil
+}
+
+func upgradeLegacySchema(ctx context.Context, tx pgx.Tx) error {
+	legacy, err := tableExists(ctx, tx, "schema_version")
+	if err != nil || !legacy {
 		return err
 	}
 
-	if count != 1 {
-		return fmt.Errorf("Expected 1 row in schema_version, got %d", count)
+	version, err := queryLegacyVersion(ctx, tx)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	_, err = tx.Exec(ctx, `
+		INSERT INTO schema_migrations (num)
+		SELECT generate_series(1, $1)
+		ON CONFLICT (migration_set, num) DO NOTHING
+	`, version)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DROP TABLE schema_version`)
+	return err
 }
 
-// Returns the current schema version in the database.
-func QuerySchemaVersion(ctx context.Context, tx pgx.Tx) (int, error) {
-	rows, err := tx.Query(ctx, `SELECT version FROM schema_version LIMIT 1`)
+// Returns the version in the legacy schema_version table, or 0 if it's empty.
+func queryLegacyVersion(ctx context.Context, tx pgx.Tx) (int, error) {
+	rows, err := tx.Query(ctx, `SELECT version FROM schema_version`)
+	if err != nil {
+		return 0, err
+	}
+
+	versions, err := pgx.CollectRows(rows, pgx.RowTo[int])
 	if err != nil {
 		return 0, err
 	}
 
-	return pgx.CollectOneRow(rows, pgx.RowTo[int])
+	if len(versions) > 1 {
+		return 0, fmt.Errorf("Expected 1 row in schema_version, got %d", len(versions))
+	}
+
+	if len(versions) == 0 {
+		return 0, nil
+	}
+
+	return versions[0], nil
+}
+
+// Returns the records EnsureSchema would create from the legacy
+// schema_version table, if there is one. The legacy table only tracks the
+// default migration set.
+func queryLegacyHistory(ctx context.Context, tx pgx.Tx, set string) ([]MigrationRecord, error) {
+	legacy, err := tableExists(ctx, tx, "schema_version")
+	if err != nil || !legacy || set != "" {
+		return nil, err
+	}
+
+	version, err := queryLegacyVersion(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []MigrationRecord
+	for num := 1; num <= version; num++ {
+		history = append(history, MigrationRecord{Num: num})
+	}
+
+	return history, nil
+}
+
+// Reports whether the table exists in the search path.
+func tableExists(ctx context.Context, tx pgx.Tx, name string) (bool, error) {
+	rows, err := tx.Query(ctx, `SELECT to_regclass($1) IS NOT NULL`, name)
+	if err != nil {
+		return false, err
+	}
+
+	return pgx.CollectOneRow(rows, pgx.RowTo[bool])
+}
+
+// Returns the current schema version of the default migration set in the
+// database.
+func QuerySchemaVersion(ctx context.Context, tx pgx.Tx) (int, error) {
+	return QuerySetSchemaVersion(ctx, tx, "")
+}
+
+// Returns the current schema version of the migration set in the database.
+// Doesn't require EnsureSchema to have been run, see querySetHistory.
+func QuerySetSchemaVersion(ctx context.Context, tx pgx.Tx, set string) (int, error) {
+	versions, err := querySetVersions(ctx, tx, set)
+	if err != nil || len(versions) == 0 {
+		return 0, err
+	}
+
+	return versions[len(versions)-1], nil
+}
+
+// Returns the numbers of the applied migrations of the migration set in
+// ascending order.
+func querySetVersions(ctx context.Context, tx pgx.Tx, set string) ([]int, error) {
+	history, err := querySetHistory(ctx, tx, set)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]int, 0, len(history))
+	for _, r := range history {
+		versions = append(versions, r.Num)
+	}
+
+	return versions, nil
+}
+
+// Returns records of all applied migrations, ordered by migration set and
+// number.
+func QueryHistory(ctx context.Context, tx pgx.Tx) ([]MigrationRecord, error) {
+	return queryHistory(ctx, tx, `ORDER BY migration_set, num`)
+}
+
+// Returns records of the applied migrations of the migration set, ordered by
+// number.
+//
+// Doesn't require EnsureSchema to have been run, so that the state can be read
+// without changing the database. Without the schema_migrations table nothing
+// is applied, except in legacy databases, where the migrations up to the
+// version in schema_version are, as EnsureSchema would record them.
+func querySetHistory(ctx context.Context, tx pgx.Tx, set string) ([]MigrationRecord, error) {
+	tracked, err := tableExists(ctx, tx, "schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	if !tracked {
+		return queryLegacyHistory(ctx, tx, set)
+	}
+
+	return queryHistory(ctx, tx, `WHERE migration_set = $1 ORDER BY num`, set)
+}
+
+func queryHistory(ctx context.Context, tx pgx.Tx, clauses string, args ...any) ([]MigrationRecord, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT migration_set, num, name, applied_at, applied_by, duration, up_checksum, down_checksum
+		FROM schema_migrations
+	`+clauses, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (MigrationRecord, error) {
+		var r MigrationRecord
+		var d pgtype.Interval
+
+		err := row.Scan(&r.Set, &r.Num, &r.Name, &r.AppliedAt, &r.AppliedBy, &d, &r.UpChecksum, &r.DownChecksum)
+		if err != nil {
+			return r, err
+		}
+
+		r.Duration = intervalToDuration(d)
+		return r, nil
+	})
 }
 
-func setSchemaVersion(ctx context.Context, tx pgx.Tx, v int) error {
-	_, err := tx.Exec(ctx, `UPDATE schema_version SET version = $1`, v)
+// Records migration m as applied.
+func recordMigration(ctx context.Context, tx pgx.Tx, m *Migration, d time.Duration) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO schema_migrations (migration_set, num, name, duration, up_checksum, down_checksum)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, m.Set, m.Num, m.Name, pgtype.Interval{Microseconds: d.Microseconds(), Valid: true}, checksum(m.Up), checksum(m.Down))
 	return err
 }
+
+// Returns the checksums of the applied repeatable migrations of the migration
+// set by name.
+func queryRepeatableChecksums(ctx context.Context, tx pgx.Tx, set string) (map[string]string, error) {
+	checksums := make(map[string]string)
+
+	// Nothing is applied before EnsureSchema creates the table.
+	tracked, err := tableExists(ctx, tx, "schema_repeatable_migrations")
+	if err != nil || !tracked {
+		return checksums, err
+	}
+
+	rows, err := tx.Query(ctx, `SELECT name, checksum FROM schema_repeatable_migrations WHERE migration_set = $1`, set)
+	if err != nil {
+		return nil, err
+	}
+
+	var name, sum string
+	_, err = pgx.ForEachRow(rows, []any{&name, &sum}, func() error {
+		checksums[name] = sum
+		return nil
+	})
+
+	return checksums, err
+}
+
+// Records repeatable migration m as applied with its current checksum.
+func recordRepeatable(ctx context.Context, tx pgx.Tx, m *Migration, d time.Duration) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO schema_repeatable_migrations (migration_set, name, checksum, duration)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (migration_set, name) DO UPDATE
+		SET checksum = EXCLUDED.checksum, applied_at = now(), applied_by = current_user, duration = EXCLUDED.duration
+	`, m.Set, m.Name, checksum(m.Up), pgtype.Interval{Microseconds: d.Microseconds(), Valid: true})
+	return err
+}
+
+// Forgets migration m, i.e. marks it as not applied.
+func forgetMigration(ctx context.Context, tx pgx.Tx, m *Migration) error {
+	_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE migration_set = $1 AND num = $2`, m.Set, m.Num)
+	return err
+}
+
+func checksum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func intervalToDuration(i pgtype.Interval) time.Duration {
+	const day = 24 * time.Hour
+
+	return time.Duration(i.Microseconds)*time.Microsecond +
+		time.Duration(i.Days)*day +
+		time.Duration(i.Months)*30*day
+}
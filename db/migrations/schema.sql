@@ -1,3 +1,59 @@
-CREATE TABLE IF NOT EXISTS schema_version (
-    version INTEGER NOT NULL DEFAULT 0
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    num INTEGER PRIMARY KEY,
+    name TEXT NOT NULL DEFAULT '',
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    applied_by TEXT NOT NULL DEFAULT current_user,
+    duration INTERVAL NOT NULL DEFAULT '0',
+    up_checksum TEXT NOT NULL DEFAULT ''
+);
+
+-- ALTER TABLE locks the table even when there is nothing to change, so the
+-- changes are only made when they're missing.
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM pg_attribute
+        WHERE attrelid = 'schema_migrations'::regclass AND attname = 'down_checksum' AND NOT attisdropped
+    ) THEN
+        ALTER TABLE schema_migrations ADD COLUMN down_checksum TEXT NOT NULL DEFAULT '';
+    END IF;
+
+    -- Each migration set tracks its own versions.
+    IF NOT EXISTS (
+        SELECT 1 FROM pg_attribute
+        WHERE attrelid = 'schema_migrations'::regclass AND attname = 'migration_set' AND NOT attisdropped
+    ) THEN
+        ALTER TABLE schema_migrations ADD COLUMN migration_set TEXT NOT NULL DEFAULT '';
+    END IF;
+
+    IF EXISTS (
+        SELECT 1 FROM pg_constraint
+        WHERE conrelid = 'schema_migrations'::regclass AND conname = 'schema_migrations_pkey'
+    ) THEN
+        ALTER TABLE schema_migrations DROP CONSTRAINT schema_migrations_pkey;
+    END IF;
+
+    IF to_regclass('schema_migrations_set_num_idx') IS NULL THEN
+        CREATE UNIQUE INDEX schema_migrations_set_num_idx ON schema_migrations (migration_set, num);
+    END IF;
+
+    -- Timestamp numbers don't fit in an INTEGER.
+    IF (
+        SELECT format_type(atttypid, NULL) FROM pg_attribute
+        WHERE attrelid = 'schema_migrations'::regclass AND attname = 'num'
+    ) <> 'bigint' THEN
+        ALTER TABLE schema_migrations ALTER COLUMN num TYPE BIGINT;
+    END IF;
+END
+$$;
+
+-- Repeatable migrations are re-run whenever their checksum changes.
+CREATE TABLE IF NOT EXISTS schema_repeatable_migrations (
+    migration_set TEXT NOT NULL DEFAULT '',
+    name TEXT NOT NULL,
+    checksum TEXT NOT NULL,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    applied_by TEXT NOT NULL DEFAULT current_user,
+    duration INTERVAL NOT NULL DEFAULT '0',
+    PRIMARY KEY (migration_set, name)
 );
@@ -0,0 +1,116 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+// MigrationSet is a named group of migrations with its own version tracking.
+type MigrationSet struct {
+	Name       string
+	Migrations MigrationSlice
+}
+
+type MigrationSets []MigrationSet
+
+// Reads all the migration sets from source. Migrations in the root of source
+// belong to the default set, which is named "" and always included.
+// Migrations in subdirectories belong to sets named after the subdirectory's
+// path (e.g. "billing" or "billing/reports").
+//
+// The sets are ordered by name.
+func MigrationSetsFromFS(source fs.FS) (MigrationSets, error) {
+	var sets MigrationSets
+
+	var walk func(dir, set string) error
+	walk = func(dir, set string) error {
+		migrations, setDirs, err := migrationsFromDir(source, dir, set)
+		if err != nil {
+			return err
+		}
+
+		if set == "" || len(migrations) > 0 {
+			sets = append(sets, MigrationSet{Name: set, Migrations: migrations})
+		}
+
+		for _, setDir := range setDirs {
+			if err := walk(setDir, setDir); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(".", ""); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(sets, func(i, j int) bool {
+		return sets[i].Name < sets[j].Name
+	})
+
+	return sets, nil
+}
+
+// Returns the set with the given name, or nil.
+func (sets MigrationSets) Find(name string) *MigrationSet {
+	for i := range sets {
+		if sets[i].Name == name {
+			return &sets[i]
+		}
+	}
+
+	return nil
+}
+
+// Ordered returns the sets named in order first, in that order, followed by
+// the rest of the sets in their current order.
+func (sets MigrationSets) Ordered(order []string) (MigrationSets, error) {
+	ordered := make(MigrationSets, 0, len(sets))
+	seen := make(map[string]bool)
+
+	for _, name := range order {
+		set := sets.Find(name)
+		if set == nil {
+			return nil, fmt.Errorf("Unknown migration set: %q", name)
+		}
+
+		if seen[name] {
+			return nil, fmt.Errorf("Migration set %q ordered twice", name)
+		}
+
+		seen[name] = true
+		ordered = append(ordered, *set)
+	}
+
+	for _, set := range sets {
+		if !seen[set.Name] {
+			ordered = append(ordered, set)
+		}
+	}
+
+	return ordered, nil
+}
+
+// Applies all pending migrations of all the sets, one set at a time in the
+// order of the sets. See MigrationSlice.ApplyAllContext.
+func (sets MigrationSets) ApplyAll(ctx context.Context, db applyDB, logger Logger, opts ...Option) error {
+	for _, set := range sets {
+		if len(set.Migrations) == 0 {
+			continue
+		}
+
+		if set.Name != "" {
+			logger.Printf("Applying migration set '%s'...", set.Name)
+		}
+
+		if err := set.Migrations.ApplyAllContext(ctx, db, logger, opts...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package migrations
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+)
+
+const noTransactionDirective = "dino:no-transaction"
+
+const baselineDirective = "dino:baseline"
+
+const irreversibleDirective = "dino:irreversible"
+
+// Section markers of single file migrations.
+const (
+	upMarker   = "-- +up"
+	downMarker = "-- +down"
+)
+
+// Splits a single file migration into the part before the first section
+// marker, and the up and down sections.
+func splitSections(script string) (preamble, up, down string, err error) {
+	var sections [3]strings.Builder
+	var seen [3]bool
+	current := 0
+
+	for _, line := range strings.SplitAfter(script, "\n") {
+		switch strings.TrimSpace(line) {
+		case upMarker:
+			if seen[1] {
+				return "", "", "", errors.New("duplicate -- +up marker")
+			}
+			if seen[2] {
+				return "", "", "", errors.New("-- +up marker after -- +down")
+			}
+			seen[1] = true
+			current = 1
+			continue
+		case downMarker:
+			if seen[2] {
+				return "", "", "", errors.New("duplicate -- +down marker")
+			}
+			seen[2] = true
+			current = 2
+			continue
+		}
+
+		sections[current].WriteString(line)
+	}
+
+	if !seen[1] {
+		return "", "", "", errors.New("missing -- +up marker")
+	}
+	if !seen[2] {
+		return "", "", "", errors.New("missing -- +down marker")
+	}
+
+	if strings.TrimSpace(stripComments(sections[0].String())) != "" {
+		return "", "", "", errors.New("statements before the -- +up marker")
+	}
+
+	return sections[0].String(), sections[1].String(), sections[2].String(), nil
+}
+
+// Reports whether the leading comment block of the script contains the
+// `-- dino:no-transaction` directive.
+func hasNoTransactionDirective(script string) bool {
+	return hasDirective(script, noTransactionDirective)
+}
+
+// Reports whether the leading comment block of the script contains the
+// `-- dino:baseline` directive.
+func hasBaselineDirective(script string) bool {
+	return hasDirective(script, baselineDirective)
+}
+
+// Reports whether the leading comment block of the script contains the
+// `-- dino:irreversible` directive.
+func hasIrreversibleDirective(script string) bool {
+	return hasDirective(script, irreversibleDirective)
+}
+
+func hasDirective(script, directive string) bool {
+	scanner := bufio.NewScanner(strings.NewReader(script))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "--") {
+			return false
+		}
+
+		if strings.TrimSpace(strings.TrimPrefix(line, "--")) == directive {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Splits the script into individual statements. Semicolons inside quotes,
+// dollar quotes and comments are not treated as separators. Empty statements
+// are dropped.
+func splitStatements(script string) []string {
+	var stmts []string
+
+	flush := func(stmt string) {
+		if strings.TrimSpace(stripComments(stmt)) != "" {
+			stmts = append(stmts, strings.TrimSpace(stmt))
+		}
+	}
+
+	start := 0
+	for i := 0; i < len(script); {
+		switch {
+		case script[i] == ';':
+			flush(script[start:i])
+			i++
+			start = i
+		case strings.HasPrefix(script[i:], "--"):
+			i = skipLineComment(script, i)
+		case strings.HasPrefix(script[i:], "/*"):
+			i = skipBlockComment(script, i)
+		case script[i] == '\'':
+			escapes := i > 0 && (script[i-1] == 'E' || script[i-1] == 'e')
+			i = skipQuoted(script, i, '\'', escapes)
+		case script[i] == '"':
+			i = skipQuoted(script, i, '"', false)
+		case script[i] == '$':
+			i = skipDollarQuoted(script, i)
+		default:
+			i++
+		}
+	}
+	flush(script[start:])
+
+	return stmts
+}
+
+// Removes comments from the script, leaving everything else intact.
+func stripComments(script string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(script); {
+		next := i + 1
+		switch {
+		case strings.HasPrefix(script[i:], "--"):
+			i = skipLineComment(script, i)
+			continue
+		case strings.HasPrefix(script[i:], "/*"):
+			i = skipBlockComment(script, i)
+			continue
+		case script[i] == '\'':
+			next = skipQuoted(script, i, '\'', i > 0 && (script[i-1] == 'E' || script[i-1] == 'e'))
+		case script[i] == '"':
+			next = skipQuoted(script, i, '"', false)
+		case script[i] == '$':
+			next = skipDollarQuoted(script, i)
+		}
+
+		b.WriteString(script[i:next])
+		i = next
+	}
+
+	return b.String()
+}
+
+func skipLineComment(script string, i int) int {
+	end := strings.IndexByte(script[i:], '\n')
+	if end < 0 {
+		return len(script)
+	}
+
+	return i + end + 1
+}
+
+// Block comments nest in PostgreSQL.
+func skipBlockComment(script string, i int) int {
+	depth := 0
+	for i < len(script) {
+		switch {
+		case strings.HasPrefix(script[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(script[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+
+	return i
+}
+
+func skipQuoted(script string, i int, quote byte, escapes bool) int {
+	for i++; i < len(script); i++ {
+		switch {
+		case escapes && script[i] == '\\':
+			i++
+		case script[i] == quote:
+			// Doubled quote is an escaped quote.
+			if i+1 < len(script) && script[i+1] == quote {
+				i++
+				continue
+			}
+
+			return i + 1
+		}
+	}
+
+	return i
+}
+
+func skipDollarQuoted(script string, i int) int {
+	// Dollar signs inside identifiers are not dollar quotes.
+	if i > 0 && isIdentChar(script[i-1]) {
+		return i + 1
+	}
+
+	end := strings.IndexByte(script[i+1:], '$')
+	if end < 0 {
+		return i + 1
+	}
+
+	tag := script[i : i+end+2]
+	for j := 1; j < len(tag)-1; j++ {
+		if !isIdentChar(tag[j]) {
+			return i + 1
+		}
+	}
+
+	// Positional parameters like $1 are not dollar quotes.
+	if len(tag) > 2 && tag[1] >= '0' && tag[1] <= '9' {
+		return i + 1
+	}
+
+	closing := strings.Index(script[i+len(tag):], tag)
+	if closing < 0 {
+		return len(script)
+	}
+
+	return i + len(tag) + closing + len(tag)
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
@@ -0,0 +1,68 @@
+package migrations
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := map[string]struct {
+		script   string
+		expected []string
+	}{
+		"simple": {
+			script:   "CREATE TABLE a (id INT);\nCREATE TABLE b (id INT);\n",
+			expected: []string{"CREATE TABLE a (id INT)", "CREATE TABLE b (id INT)"},
+		},
+		"no trailing semicolon": {
+			script:   "SELECT 1;\nSELECT 2",
+			expected: []string{"SELECT 1", "SELECT 2"},
+		},
+		"quotes": {
+			script:   `SELECT 'a;b', "c;d", E'\';';`,
+			expected: []string{`SELECT 'a;b', "c;d", E'\';'`},
+		},
+		"comments": {
+			script:   "-- first; comment\nSELECT 1; /* block; /* nested; */ */\n-- trailing;\n",
+			expected: []string{"-- first; comment\nSELECT 1"},
+		},
+		"dollar quotes": {
+			script: "CREATE FUNCTION f() RETURNS INT AS $body$ SELECT 1; $body$ LANGUAGE sql;\n" +
+				"DO $$ BEGIN PERFORM 1; END $$;",
+			expected: []string{
+				"CREATE FUNCTION f() RETURNS INT AS $body$ SELECT 1; $body$ LANGUAGE sql",
+				"DO $$ BEGIN PERFORM 1; END $$",
+			},
+		},
+		"empty": {
+			script:   "  ;\n-- nothing here\n",
+			expected: nil,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := splitStatements(tt.script)
+			if diff := cmp.Diff(got, tt.expected); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestHasNoTransactionDirective(t *testing.T) {
+	tests := map[string]bool{
+		"-- dino:no-transaction\nCREATE INDEX CONCURRENTLY i ON t (c);":          true,
+		"\n-- Add an index.\n--   dino:no-transaction\nCREATE INDEX i ON t (c);": true,
+		"CREATE INDEX i ON t (c);\n-- dino:no-transaction\n":                     false,
+		"-- dino:no-transactions\nCREATE INDEX i ON t (c);":                      false,
+		"": false,
+	}
+
+	for script, expected := range tests {
+		if got := hasNoTransactionDirective(script); got != expected {
+			t.Errorf("%q: got %v, expected %v", script, got, expected)
+		}
+	}
+}
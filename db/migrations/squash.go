@@ -0,0 +1,77 @@
+package migrations
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// Directory in the migration set's directory where Squash moves the squashed
+// migrations. Hidden, so that the archived migrations are neither read nor
+// linted.
+const archiveDir = ".archive"
+
+// Squash replaces the migrations up to and including upTo with a baseline
+// migration running schema, e.g. a schema only dump of a database migrated to
+// upTo. baseDir should point to the directory where all the migrations of the
+// set live. The squashed migrations are moved to the .archive subdirectory of
+// baseDir.
+//
+// The baseline takes the number upTo, so databases already migrated to upTo
+// or further are compatible with it, while fresh databases start from it.
+// Baselines cannot be reverted.
+func (slice MigrationSlice) Squash(baseDir string, upTo int, schema string) (*Migration, error) {
+	if slice.Find(upTo) == nil {
+		return nil, fmt.Errorf("Migration %d not found", upTo)
+	}
+
+	var squashed MigrationSlice
+	for _, m := range slice.numbered() {
+		if m.Num > upTo {
+			continue
+		}
+
+		if m.UpFunc != nil {
+			return nil, fmt.Errorf("Go migration '%s' cannot be archived, unregister it before squashing", m.Name)
+		}
+
+		squashed = append(squashed, m)
+	}
+
+	if err := os.MkdirAll(baseDir+"/"+archiveDir, 0755); err != nil {
+		return nil, err
+	}
+
+	for _, m := range squashed {
+		p := migrationPath(baseDir, m.Name)
+		if err := os.Rename(p, baseDir+"/"+archiveDir+"/"+path.Base(p)); err != nil {
+			return nil, err
+		}
+	}
+
+	name := fmt.Sprintf("%04d_%s_baseline", upTo, time.Now().Format(format))
+	dir := baseDir + "/" + name
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files := map[string]string{
+		"/up.sql":              fmt.Sprintf("-- %s\n%s", baselineDirective, schema),
+		"/down.sql":            "",
+		"/" + irreversibleFile: "Baselines cannot be reverted.\n",
+	}
+
+	for fname, contents := range files {
+		if err := os.WriteFile(dir+fname, []byte(contents), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Migration{
+		Name:         name,
+		Num:          upTo,
+		Baseline:     true,
+		Irreversible: true,
+	}, nil
+}
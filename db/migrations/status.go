@@ -0,0 +1,122 @@
+package migrations
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// State of a single migration in the database.
+type MigrationStatus struct {
+	Num       int        `json:"num"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	// Unknown is set for migrations that are applied to the database, but
+	// are missing from the migrations.
+	Unknown bool `json:"unknown"`
+	// OutOfOrder is set for pending migrations that are older than the
+	// latest applied migration.
+	OutOfOrder bool `json:"out_of_order"`
+}
+
+// Combined state of the migrations and the database.
+type Status struct {
+	Set        string            `json:"set"`
+	Version    int               `json:"version"`
+	Migrations []MigrationStatus `json:"migrations"`
+}
+
+// Returns the migrations that are applied to the database, but are missing
+// from the migrations.
+func (s *Status) Unknown() []MigrationStatus {
+	var unknown []MigrationStatus
+	for _, m := range s.Migrations {
+		if m.Unknown {
+			unknown = append(unknown, m)
+		}
+	}
+
+	return unknown
+}
+
+// Returns the migrations that are not applied to the database.
+func (s *Status) Pending() []MigrationStatus {
+	var pending []MigrationStatus
+	for _, m := range s.Migrations {
+		if !m.Applied {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending
+}
+
+// Status combines the numbered migrations with the database's schema state.
+// The returned migrations are ordered by their number.
+//
+// Status doesn't change the database. A database without the tables tracking
+// migrations has nothing applied, and a legacy database has the migrations up
+// to the version in its schema_version table applied.
+func (slice MigrationSlice) Status(ctx context.Context, tx pgx.Tx) (*Status, error) {
+	version, err := QuerySetSchemaVersion(ctx, tx, slice.set())
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := querySetHistory(ctx, tx, slice.set())
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]MigrationRecord, len(history))
+	for _, r := range history {
+		applied[r.Num] = r
+	}
+
+	status := &Status{Set: slice.set(), Version: version}
+	for _, m := range slice.numbered() {
+		s := MigrationStatus{Num: m.Num, Name: m.Name}
+
+		if r, ok := applied[m.Num]; ok {
+			s.Applied = true
+			s.AppliedAt = appliedAt(r)
+			delete(applied, m.Num)
+		} else {
+			s.OutOfOrder = m.Num < version
+		}
+
+		status.Migrations = append(status.Migrations, s)
+	}
+
+	// Migrations replaced by the baseline are expected to be missing.
+	baseline := slice.baseline()
+	for _, r := range applied {
+		r := r
+		status.Migrations = append(status.Migrations, MigrationStatus{
+			Num:       r.Num,
+			Name:      r.Name,
+			Applied:   true,
+			AppliedAt: appliedAt(r),
+			Unknown:   baseline == nil || r.Num > baseline.Num,
+		})
+	}
+
+	sort.SliceStable(status.Migrations, func(i, j int) bool {
+		return status.Migrations[i].Num < status.Migrations[j].Num
+	})
+
+	return status, nil
+}
+
+// Returns nil for records read from the legacy schema_version table, which
+// didn't store the time.
+func appliedAt(r MigrationRecord) *time.Time {
+	if r.AppliedAt.IsZero() {
+		return nil
+	}
+
+	return &r.AppliedAt
+}
@@ -0,0 +1,66 @@
+package migrations
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Template holds text/template sources for the up and down scripts of new
+// migrations. The templates are executed with TemplateData.
+type Template struct {
+	Up   string
+	Down string
+}
+
+// Data available in migration templates.
+type TemplateData struct {
+	// Full name of the migration, e.g. 0004_20240101_1200_create_users.
+	Name string
+	Num  int
+	// Name given for the migration, e.g. create_users.
+	Description string
+	// Table name for migrations named create_<table>, empty otherwise.
+	Table  string
+	Author string
+	Ticket string
+	Date   time.Time
+}
+
+var templateFuncs = template.FuncMap{
+	"hasPrefix":  strings.HasPrefix,
+	"hasSuffix":  strings.HasSuffix,
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+}
+
+func (t *Template) render(data *TemplateData) (up, down string, err error) {
+	up, err = renderTemplate("up", t.Up, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	down, err = renderTemplate("down", t.Down, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	return up, down, nil
+}
+
+func renderTemplate(name, source string, data *TemplateData) (string, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(source)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
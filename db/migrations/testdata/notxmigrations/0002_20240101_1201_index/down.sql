@@ -0,0 +1,2 @@
+-- dino:no-transaction
+DROP INDEX CONCURRENTLY items_name_idx;
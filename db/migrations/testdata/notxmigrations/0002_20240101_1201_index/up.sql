@@ -0,0 +1,2 @@
+-- dino:no-transaction
+CREATE INDEX CONCURRENTLY items_name_idx ON items (name);
@@ -0,0 +1,3 @@
+CREATE TABLE core (
+    id SERIAL PRIMARY KEY
+);
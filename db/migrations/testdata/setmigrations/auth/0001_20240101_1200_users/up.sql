@@ -0,0 +1,3 @@
+CREATE TABLE users (
+    id SERIAL PRIMARY KEY
+);
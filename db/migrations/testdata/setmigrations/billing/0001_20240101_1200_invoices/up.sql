@@ -0,0 +1,3 @@
+CREATE TABLE invoices (
+    id SERIAL PRIMARY KEY
+);
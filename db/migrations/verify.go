@@ -0,0 +1,86 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Drift describes an applied migration whose files no longer match the
+// checksums recorded in the database.
+type Drift struct {
+	Num  int
+	Name string
+	Up   bool
+	Down bool
+}
+
+func (d Drift) String() string {
+	var files []string
+	if d.Up {
+		files = append(files, "up.sql")
+	}
+	if d.Down {
+		files = append(files, "down.sql")
+	}
+
+	return fmt.Sprintf("%s: %s", d.Name, strings.Join(files, ", "))
+}
+
+// DriftError is returned when one or more applied migrations have been
+// modified after they were applied.
+type DriftError struct {
+	Drifted []Drift
+}
+
+func (e *DriftError) Error() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%d applied migration(s) have drifted from what the database recorded:", len(e.Drifted))
+	for _, d := range e.Drifted {
+		fmt.Fprintf(&b, "\n  %s", d)
+	}
+
+	return b.String()
+}
+
+// Verify compares the migrations against the checksums recorded in the
+// database when they were applied. Returns *DriftError if any of them have
+// changed since.
+//
+// Applied migrations that are missing from the slice, or that have no
+// recorded checksums, are skipped.
+func (slice MigrationSlice) Verify(ctx context.Context, tx pgx.Tx) error {
+	history, err := querySetHistory(ctx, tx, slice.set())
+	if err != nil {
+		return err
+	}
+
+	var drifted []Drift
+	for _, r := range history {
+		m := slice.Find(r.Num)
+		// Databases migrated before squashing recorded the squashed migration.
+		if m == nil || (m.Baseline && r.Name != m.Name) {
+			continue
+		}
+
+		d := Drift{
+			Num:  m.Num,
+			Name: m.Name,
+			Up:   r.UpChecksum != "" && r.UpChecksum != checksum(m.Up),
+			Down: r.DownChecksum != "" && r.DownChecksum != checksum(m.Down),
+		}
+
+		if d.Up || d.Down {
+			drifted = append(drifted, d)
+		}
+	}
+
+	if len(drifted) > 0 {
+		return &DriftError{Drifted: drifted}
+	}
+
+	return nil
+}